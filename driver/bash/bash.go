@@ -2,6 +2,8 @@
 package bash
 
 import (
+	"errors"
+
 	"github.com/gemnasium/migrate/driver"
 	"github.com/gemnasium/migrate/file"
 )
@@ -24,6 +26,9 @@ func (driver *Driver) FilenameExtension() string {
 func (driver *Driver) Migrate(f file.File, pipe chan interface{}) {
 	defer close(pipe)
 	pipe <- f
+	if f.Func != nil {
+		pipe <- errors.New("Go migrations are not supported by the bash driver")
+	}
 	return
 }
 
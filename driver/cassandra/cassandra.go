@@ -2,6 +2,8 @@
 package cassandra
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/url"
 	"sort"
@@ -10,18 +12,24 @@ import (
 	"time"
 
 	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/event"
 	"github.com/gemnasium/migrate/file"
 	"github.com/gemnasium/migrate/migrate/direction"
+	"github.com/gemnasium/migrate/sqlsplit"
 	"github.com/gocql/gocql"
 )
 
 type Driver struct {
 	session *gocql.Session
+
+	// lockOwner identifies the lock row inserted by this driver
+	lockOwner gocql.UUID
+
+	// table is the version table, see driver.ParseTable
+	table driver.Table
 }
 
-const (
-	tableName = "schema_migrations"
-)
+const defaultTableName = "schema_migrations"
 
 // Cassandra Driver URL format:
 // cassandra://host:port/keyspace?protocol=version&consistency=level
@@ -30,7 +38,16 @@ const (
 // cassandra://localhost/SpaceOfKeys?protocol=4
 // cassandra://localhost/SpaceOfKeys?protocol=4&consistency=all
 // cassandra://localhost/SpaceOfKeys?consistency=quorum
+//
+// The table name and its keyspace can be set with the
+// x-migrations-table and x-migrations-schema params.
 func (driver *Driver) Initialize(rawurl string) error {
+	rawurl, table, err := parseTable(rawurl)
+	if err != nil {
+		return err
+	}
+	driver.table = table
+
 	u, err := url.Parse(rawurl)
 
 	cluster := gocql.NewCluster(u.Host)
@@ -93,8 +110,38 @@ func (driver *Driver) Close() error {
 }
 
 func (driver *Driver) ensureVersionTableExists() error {
-	err := driver.session.Query("CREATE TABLE IF NOT EXISTS " + tableName + " (version bigint primary key);").Exec()
-	return err
+	err := driver.session.Query("CREATE TABLE IF NOT EXISTS " + driver.versionTable() + " (version bigint primary key);").Exec()
+	if err != nil {
+		return err
+	}
+	return driver.addMissingColumns()
+}
+
+// versionColumns are the columns added to the version table over time.
+var versionColumns = []struct{ name, definition string }{
+	{"checksum", "text"},
+	{"dirty", "boolean"},
+	{"name", "text"},
+	{"applied_at", "timestamp"},
+	{"duration_ms", "bigint"},
+	{"host", "text"},
+}
+
+// addMissingColumns upgrades version tables created by older releases.
+func (driver *Driver) addMissingColumns() error {
+	for _, column := range versionColumns {
+		ok, err := hasColumn(driver.session, driver.versionTable(), column.name)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		if err := driver.session.Query("ALTER TABLE " + driver.versionTable() + " ADD " + column.name + " " + column.definition).Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (driver *Driver) FilenameExtension() string {
@@ -102,44 +149,92 @@ func (driver *Driver) FilenameExtension() string {
 }
 
 func (driver *Driver) Migrate(f file.File, pipe chan interface{}) {
-	var err error
-	defer func() {
-		if err != nil {
-			// Invert version direction if we couldn't apply the changes for some reason.
-			if errRollback := driver.session.Query("DELETE FROM "+tableName+" WHERE version = ?", f.Version).Exec(); errRollback != nil {
-				pipe <- errRollback
-			}
-			pipe <- err
-		}
-		close(pipe)
-	}()
+	driver.MigrateContext(context.Background(), f, pipe)
+}
 
+// MigrateContext is like Migrate, but cancels the running query once
+// ctx is done. Cassandra can't roll back queries already executed, so
+// the version is flagged as dirty until all queries succeed.
+func (driver *Driver) MigrateContext(ctx context.Context, f file.File, pipe chan interface{}) {
+	defer close(pipe)
 	pipe <- f
+	start := time.Now()
+
+	if f.Func != nil {
+		pipe <- errors.New("Go migrations are not supported by the cassandra driver")
+		return
+	}
+
+	checksum, err := f.Checksum()
+	if err != nil {
+		pipe <- err
+		return
+	}
 
-	if err = f.ReadContent(); err != nil {
+	statements, err := sqlsplit.Split(f.Content, sqlsplit.Cassandra)
+	if err != nil {
+		pipe <- err
 		return
 	}
 
 	if f.Direction == direction.Up {
-		if err = driver.session.Query("INSERT INTO "+tableName+" (version) VALUES (?)", f.Version).Exec(); err != nil {
-			return
-		}
+		err = driver.session.Query("INSERT INTO "+driver.versionTable()+" (version, checksum, name, host, applied_at, dirty) VALUES (?, ?, ?, ?, ?, true)", f.Version, checksum, f.Name, host(), start).WithContext(ctx).Exec()
 	} else if f.Direction == direction.Down {
-		if err = driver.session.Query("DELETE FROM "+tableName+" WHERE version = ?", f.Version).Exec(); err != nil {
+		err = driver.session.Query("UPDATE "+driver.versionTable()+" SET dirty = true WHERE version = ?", f.Version).WithContext(ctx).Exec()
+	}
+	if err != nil {
+		pipe <- err
+		return
+	}
+
+	for i, statement := range statements {
+		if err := driver.session.Query(statement.Text).WithContext(ctx).Exec(); err != nil {
+			pipe <- describeError(f, i, statement, err)
+			// the version stays dirty only if a statement may have been applied
+			if i == 0 && !mayBeApplied(err) {
+				if err := driver.ClearDirty(f.Version, f.Direction == direction.Down); err != nil {
+					pipe <- err
+				}
+			}
 			return
 		}
+		pipe <- event.Event{Kind: event.StatementExecuted, File: &f, Statement: statement.Text, Offset: statement.Offset}
 	}
 
-	for _, query := range strings.Split(string(f.Content), ";") {
-		query = strings.TrimSpace(query)
-		if len(query) == 0 {
-			continue
-		}
+	if f.Direction == direction.Up {
+		err = driver.session.Query("UPDATE "+driver.versionTable()+" SET dirty = false, duration_ms = ? WHERE version = ?", int64(time.Since(start)/time.Millisecond), f.Version).WithContext(ctx).Exec()
+	} else if f.Direction == direction.Down {
+		err = driver.session.Query("DELETE FROM "+driver.versionTable()+" WHERE version = ?", f.Version).WithContext(ctx).Exec()
+	}
+	if err != nil {
+		pipe <- err
+	}
+}
 
-		if err = driver.session.Query(query).Exec(); err != nil {
-			return
-		}
+// Lock inserts the single row of the lock table with a lightweight
+// transaction, waiting for it to be deleted if another run already holds
+// the lock. The row is left behind if the process running the migrations
+// dies: delete it by hand then.
+func (driver *Driver) Lock(ctx context.Context) error {
+	if err := driver.session.Query("CREATE TABLE IF NOT EXISTS " + driver.lockTable() + " (id int primary key, owner timeuuid);").WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	driver.lockOwner = gocql.TimeUUID()
+	return insertLockRow(ctx, driver.session, driver.lockTable(), driver.lockOwner)
+}
+
+// Unlock deletes the row inserted by Lock, if it still belongs to this driver.
+func (driver *Driver) Unlock() error {
+	_, err := driver.session.Query("DELETE FROM "+driver.lockTable()+" WHERE id = 1 IF owner = ?", driver.lockOwner).MapScanCAS(map[string]interface{}{})
+	return err
+}
+
+// ForceUnlock deletes the row inserted by Lock, whoever inserted it.
+func (driver *Driver) ForceUnlock() error {
+	if err := driver.session.Query("CREATE TABLE IF NOT EXISTS " + driver.lockTable() + " (id int primary key, owner timeuuid);").Exec(); err != nil {
+		return err
 	}
+	return driver.session.Query("DELETE FROM " + driver.lockTable() + " WHERE id = 1").Exec()
 }
 
 // Version returns the current migration version.
@@ -154,7 +249,7 @@ func (driver *Driver) Version() (file.Version, error) {
 // Versions returns the list of applied migrations.
 func (driver *Driver) Versions() (file.Versions, error) {
 	versions := file.Versions{}
-	iter := driver.session.Query("SELECT version FROM " + tableName).Iter()
+	iter := driver.session.Query("SELECT version FROM " + driver.versionTable()).Iter()
 	var version int64
 	for iter.Scan(&version) {
 		versions = append(versions, file.Version(version))
@@ -164,8 +259,155 @@ func (driver *Driver) Versions() (file.Versions, error) {
 	return versions, err
 }
 
+// Checksums returns the checksums of the applied migrations.
+// Migrations applied before checksums were recorded are left out.
+func (driver *Driver) Checksums() (map[file.Version]string, error) {
+	checksums := make(map[file.Version]string)
+	iter := driver.session.Query("SELECT version, checksum FROM " + driver.versionTable()).Iter()
+	var version int64
+	var checksum string
+	for iter.Scan(&version, &checksum) {
+		if checksum != "" {
+			checksums[file.Version(version)] = checksum
+		}
+	}
+	return checksums, iter.Close()
+}
+
+// Records returns the applied migrations, newest first.
+func (driver *Driver) Records() ([]driver.Record, error) {
+	return readRecords(driver.session, driver.versionTable())
+}
+
+// Dirty returns the versions of the migrations which didn't complete.
+func (driver *Driver) Dirty() (file.Versions, error) {
+	versions := file.Versions{}
+	iter := driver.session.Query("SELECT version, dirty FROM " + driver.versionTable()).Iter()
+	var version int64
+	var dirty bool
+	for iter.Scan(&version, &dirty) {
+		if dirty {
+			versions = append(versions, file.Version(version))
+		}
+	}
+	err := iter.Close()
+	sort.Sort(sort.Reverse(versions))
+	return versions, err
+}
+
+// ClearDirty removes the dirty flag of version, removing version
+// altogether unless applied is true.
+func (driver *Driver) ClearDirty(version file.Version, applied bool) error {
+	if applied {
+		return driver.session.Query("UPDATE "+driver.versionTable()+" SET dirty = false WHERE version = ?", version).Exec()
+	}
+	return driver.session.Query("DELETE FROM "+driver.versionTable()+" WHERE version = ?", version).Exec()
+}
+
+// Retryable reports whether err is a read or write timeout, or a lack of
+// available replicas. Cassandra has no transactions: only files with
+// the retries directive are run again.
+func (driver *Driver) Retryable(err error) bool {
+	var writeTimeout *gocql.RequestErrWriteTimeout
+	var readTimeout *gocql.RequestErrReadTimeout
+	var unavailable *gocql.RequestErrUnavailable
+	return errors.As(err, &writeTimeout) || errors.As(err, &readTimeout) || errors.As(err, &unavailable) ||
+		errors.Is(err, gocql.ErrTimeoutNoResponse)
+}
+
+// mayBeApplied reports whether a statement failing with err may have
+// been applied anyway, as it timed out waiting for replicas or for the
+// response.
+func mayBeApplied(err error) bool {
+	var writeTimeout *gocql.RequestErrWriteTimeout
+	return errors.As(err, &writeTimeout) || errors.Is(err, gocql.ErrTimeoutNoResponse) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// hasColumn reports whether table has the column name. Selecting the
+// column is the only way to know if it exists that works with all
+// Cassandra versions: it is an invalid query naming an undefined column
+// if it doesn't, other errors are returned.
+func hasColumn(session *gocql.Session, table, name string) (bool, error) {
+	err := session.Query("SELECT " + name + " FROM " + table + " LIMIT 1").Exec()
+	var requestErr gocql.RequestError
+	if errors.As(err, &requestErr) && requestErr.Code() == gocql.ErrCodeInvalid && strings.Contains(requestErr.Message(), "Undefined") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// describeError returns err, raised by the statement at index i of f,
+// as a *driver.MigrationError located at the start of the statement,
+// with the code of Cassandra errors.
+func describeError(f file.File, i int, statement sqlsplit.Statement, err error) error {
+	code := ""
+	var requestErr gocql.RequestError
+	if errors.As(err, &requestErr) {
+		code = fmt.Sprintf("0x%04x", requestErr.Code())
+	}
+	return driver.NewMigrationError(f, i, statement.Offset, code, err)
+}
+
+// readRecords reads the version table into records.
+func readRecords(session *gocql.Session, table string) ([]driver.Record, error) {
+	records := []driver.Record{}
+	iter := session.Query("SELECT version, name, applied_at, duration_ms, host FROM " + table).Iter()
+	var version, durationMs int64
+	var name, host string
+	var appliedAt time.Time
+	for iter.Scan(&version, &name, &appliedAt, &durationMs, &host) {
+		records = append(records, driver.Record{
+			Version:   file.Version(version),
+			Name:      name,
+			AppliedAt: appliedAt,
+			Duration:  time.Duration(durationMs) * time.Millisecond,
+			Host:      host,
+		})
+	}
+	if err := iter.Close(); err != nil {
+		return records, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Version > records[j].Version
+	})
+	return records, nil
+}
+
+// parseTable reads the version table from url.
+func parseTable(rawurl string) (string, driver.Table, error) {
+	return driver.ParseTable(rawurl, defaultTableName)
+}
+
+// versionTable returns the version table name to use in queries.
+func (driver *Driver) versionTable() string {
+	return driver.table.QualifiedName(quoteIdentifier)
+}
+
+// lockTable returns the lock table name to use in queries.
+func (driver *Driver) lockTable() string {
+	return driver.table.Suffixed("_lock").QualifiedName(quoteIdentifier)
+}
+
+// quoteIdentifier quotes table and keyspace names.
+func quoteIdentifier(name string) string {
+	return driver.QuoteIdentifier(name)
+}
+
+// host returns the value recorded in the host column.
+func host() string {
+	return driver.Host()
+}
+
+// insertLockRow polls until the lock row could be inserted.
+func insertLockRow(ctx context.Context, session *gocql.Session, table string, owner gocql.UUID) error {
+	return driver.PollLock(ctx, func() (bool, error) {
+		return session.Query("INSERT INTO "+table+" (id, owner) VALUES (1, ?) IF NOT EXISTS", owner).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	})
+}
+
 func init() {
-	driver.RegisterDriver("cassandra", &Driver{})
+	driver.RegisterFactory("cassandra", func() driver.Driver { return &Driver{} })
 }
 
 // ParseConsistency wraps gocql.ParseConsistency to return an error
@@ -0,0 +1,13 @@
+package driver
+
+import "github.com/gemnasium/migrate/file"
+
+// Checker is implemented by drivers able to tell that a migration file
+// will fail before running it, such as a statement which can't run in
+// the transaction of the file. Runs check all their files before
+// running any, so that none runs if one of them would fail this way.
+type Checker interface {
+
+	// Check returns an error describing why f can't run, if it can't.
+	Check(f file.File) error
+}
@@ -0,0 +1,12 @@
+package driver
+
+import "github.com/gemnasium/migrate/file"
+
+// ChecksumReader is implemented by drivers recording the checksum of
+// each applied up migration file, as returned by file.File.Checksum.
+type ChecksumReader interface {
+
+	// Checksums returns the recorded checksums by version.
+	// Versions applied before checksums were recorded are left out.
+	Checksums() (map[file.Version]string, error)
+}
@@ -2,27 +2,45 @@
 package crate
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/event"
 	"github.com/gemnasium/migrate/file"
 	"github.com/gemnasium/migrate/migrate/direction"
+	"github.com/gemnasium/migrate/sqlsplit"
 	_ "github.com/herenow/go-crate"
 )
 
 func init() {
-	driver.RegisterDriver("crate", &Driver{})
+	driver.RegisterFactory("crate", func() driver.Driver { return &Driver{} })
 }
 
 type Driver struct {
 	db *sql.DB
+
+	// table is the version table, see driver.ParseTable
+	table driver.Table
 }
 
-const tableName = "schema_migrations"
+const defaultTableName = "schema_migrations"
+
+// defaultSchema is the schema of tables created without one.
+const defaultSchema = "doc"
 
+// The table name and its schema can be set with the
+// x-migrations-table and x-migrations-schema params.
 func (driver *Driver) Initialize(url string) error {
+	url, table, err := parseTable(url)
+	if err != nil {
+		return err
+	}
+	driver.table = table
+
 	url = strings.Replace(url, "crate", "http", 1)
 	db, err := sql.Open("crate", url)
 	if err != nil {
@@ -54,7 +72,7 @@ func (driver *Driver) FilenameExtension() string {
 // Version returns the current migration version.
 func (driver *Driver) Version() (file.Version, error) {
 	var version file.Version
-	err := driver.db.QueryRow("SELECT version FROM " + tableName + " ORDER BY version DESC LIMIT 1").Scan(&version)
+	err := driver.db.QueryRow("SELECT version FROM " + driver.versionTable() + " ORDER BY version DESC LIMIT 1").Scan(&version)
 	switch {
 	case err == sql.ErrNoRows:
 		return 0, nil
@@ -69,7 +87,7 @@ func (driver *Driver) Version() (file.Version, error) {
 func (driver *Driver) Versions() (file.Versions, error) {
 	versions := file.Versions{}
 
-	rows, err := driver.db.Query("SELECT version FROM " + tableName + " ORDER BY version DESC")
+	rows, err := driver.db.Query("SELECT version FROM " + driver.versionTable() + " ORDER BY version DESC")
 	if err != nil {
 		return versions, err
 	}
@@ -86,53 +104,268 @@ func (driver *Driver) Versions() (file.Versions, error) {
 	return versions, err
 }
 
+// Checksums returns the checksums of the applied migrations.
+// Migrations applied before checksums were recorded are left out.
+func (driver *Driver) Checksums() (map[file.Version]string, error) {
+	checksums := make(map[file.Version]string)
+
+	rows, err := driver.db.Query("SELECT version, checksum FROM " + driver.versionTable())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version file.Version
+		var checksum sql.NullString
+		if err := rows.Scan(&version, &checksum); err != nil {
+			return nil, err
+		}
+		if checksum.Valid {
+			checksums[version] = checksum.String
+		}
+	}
+	return checksums, rows.Err()
+}
+
+// Records returns the applied migrations, newest first.
+func (driver *Driver) Records() ([]driver.Record, error) {
+	return readRecords(driver.db, driver.versionTable())
+}
+
+// Dirty returns the versions of the migrations which didn't complete.
+func (driver *Driver) Dirty() (file.Versions, error) {
+	versions := file.Versions{}
+
+	rows, err := driver.db.Query("SELECT version FROM " + driver.versionTable() + " WHERE dirty = true ORDER BY version DESC")
+	if err != nil {
+		return versions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version file.Version
+		if err := rows.Scan(&version); err != nil {
+			return versions, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// ClearDirty removes the dirty flag of version, removing version
+// altogether unless applied is true.
+func (driver *Driver) ClearDirty(version file.Version, applied bool) error {
+	var err error
+	if applied {
+		_, err = driver.db.Exec("UPDATE "+driver.versionTable()+" SET dirty = false WHERE version=?", version)
+	} else {
+		_, err = driver.db.Exec("DELETE FROM "+driver.versionTable()+" WHERE version=?", version)
+	}
+	return err
+}
+
 func (driver *Driver) Migrate(f file.File, pipe chan interface{}) {
+	driver.MigrateContext(context.Background(), f, pipe)
+}
+
+// MigrateContext is like Migrate, but stops before the next statement
+// once ctx is done. Crate has no transactions, so statements already
+// executed are not rolled back: the version is flagged as dirty until
+// all statements succeed.
+func (driver *Driver) MigrateContext(ctx context.Context, f file.File, pipe chan interface{}) {
 	defer close(pipe)
 	pipe <- f
+	start := time.Now()
+
+	checksum, err := f.Checksum()
+	if err != nil {
+		pipe <- err
+		return
+	}
 
-	if err := f.ReadContent(); err != nil {
+	statements, err := sqlsplit.Split(f.Content, sqlsplit.Crate)
+	if err != nil {
 		pipe <- err
 		return
 	}
 
-	lines := splitContent(string(f.Content))
-	for _, line := range lines {
-		_, err := driver.db.Exec(line)
-		if err != nil {
-			pipe <- err
+	// the version of a failed run may still be there
+	if f.Direction == direction.Up {
+		_, err = driver.db.ExecContext(ctx, "INSERT INTO "+driver.versionTable()+" (version, checksum, name, host, applied_at, dirty) VALUES (?, ?, ?, ?, ?, true)"+
+			" ON CONFLICT (version) DO UPDATE SET checksum = excluded.checksum, name = excluded.name, host = excluded.host, applied_at = excluded.applied_at, dirty = true", f.Version, checksum, f.Name, host(), start.UnixNano()/int64(time.Millisecond))
+	} else if f.Direction == direction.Down {
+		_, err = driver.db.ExecContext(ctx, "UPDATE "+driver.versionTable()+" SET dirty = true WHERE version=?", f.Version)
+	}
+	if err != nil {
+		pipe <- err
+		return
+	}
+
+	if f.Func != nil {
+		if err := f.Func(ctx, driver.db); err != nil {
+			pipe <- migrationError(f, 0, -1, err)
 			return
 		}
 	}
 
+	for i, statement := range statements {
+		if _, err := driver.db.ExecContext(ctx, statement.Text); err != nil {
+			pipe <- migrationError(f, i, statement.Offset, err)
+			return
+		}
+		pipe <- event.Event{Kind: event.StatementExecuted, File: &f, Statement: statement.Text, Offset: statement.Offset}
+	}
+
 	if f.Direction == direction.Up {
-		if _, err := driver.db.Exec("INSERT INTO "+tableName+" (version) VALUES (?)", f.Version); err != nil {
+		if _, err := driver.db.ExecContext(ctx, "UPDATE "+driver.versionTable()+" SET dirty = false, duration_ms = ? WHERE version=?", milliseconds(time.Since(start)), f.Version); err != nil {
 			pipe <- err
 			return
 		}
 	} else if f.Direction == direction.Down {
-		if _, err := driver.db.Exec("DELETE FROM "+tableName+" WHERE version=?", f.Version); err != nil {
+		if _, err := driver.db.ExecContext(ctx, "DELETE FROM "+driver.versionTable()+" WHERE version=?", f.Version); err != nil {
 			pipe <- err
 			return
 		}
 	}
 }
 
-func splitContent(content string) []string {
-	lines := strings.Split(content, ";")
-	resultLines := make([]string, 0, len(lines))
-	for i, line := range lines {
-		line = strings.Replace(lines[i], ";", "", -1)
-		line = strings.TrimSpace(line)
-		if line != "" {
-			resultLines = append(resultLines, line)
+// Lock inserts the single row of the lock table, waiting for it to be
+// deleted if another run already holds the lock. The row is left behind
+// if the process running the migrations dies: delete it by hand then.
+func (driver *Driver) Lock(ctx context.Context) error {
+	if _, err := driver.db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY)", driver.lockTable())); err != nil {
+		return err
+	}
+	return insertLockRow(ctx, driver.db, driver.lockTable())
+}
+
+// Unlock deletes the row inserted by Lock.
+func (driver *Driver) Unlock() error {
+	_, err := driver.db.Exec("DELETE FROM " + driver.lockTable() + " WHERE id = 1")
+	return err
+}
+
+// ForceUnlock deletes the row inserted by Lock, whoever inserted it.
+func (driver *Driver) ForceUnlock() error {
+	if _, err := driver.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY)", driver.lockTable())); err != nil {
+		return err
+	}
+	return driver.Unlock()
+}
+
+// insertLockRow polls until the lock row could be inserted.
+// Crate rejects a second row with the same primary key.
+func insertLockRow(ctx context.Context, db *sql.DB, table string) error {
+	return driver.PollLock(ctx, func() (bool, error) {
+		_, err := db.ExecContext(ctx, "INSERT INTO "+table+" (id) VALUES (1)")
+		if err != nil && strings.Contains(err.Error(), "DuplicateKey") {
+			return false, nil
 		}
+		return err == nil, err
+	})
+}
+
+// readRecords reads the version table into records.
+// Crate returns timestamps as milliseconds since the epoch.
+func readRecords(db *sql.DB, table string) ([]driver.Record, error) {
+	records := []driver.Record{}
+
+	rows, err := db.Query("SELECT version, name, applied_at, duration_ms, host FROM " + table + " ORDER BY version DESC")
+	if err != nil {
+		return records, err
 	}
-	return resultLines
+	defer rows.Close()
+	for rows.Next() {
+		var version file.Version
+		var name, host sql.NullString
+		var appliedAt, durationMs sql.NullInt64
+		if err := rows.Scan(&version, &name, &appliedAt, &durationMs, &host); err != nil {
+			return records, err
+		}
+		record := driver.Record{
+			Version:  version,
+			Name:     name.String,
+			Duration: time.Duration(durationMs.Int64) * time.Millisecond,
+			Host:     host.String,
+		}
+		if appliedAt.Valid {
+			record.AppliedAt = time.Unix(0, appliedAt.Int64*int64(time.Millisecond))
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// parseTable reads the version table from url.
+func parseTable(url string) (string, driver.Table, error) {
+	return driver.ParseTable(url, defaultTableName)
+}
+
+// versionTable returns the version table name to use in queries.
+func (driver *Driver) versionTable() string {
+	return driver.table.QualifiedName(quoteIdentifier)
+}
+
+// lockTable returns the lock table name to use in queries.
+func (driver *Driver) lockTable() string {
+	return driver.table.Suffixed("_lock").QualifiedName(quoteIdentifier)
+}
+
+// quoteIdentifier quotes table and schema names.
+func quoteIdentifier(name string) string {
+	return driver.QuoteIdentifier(name)
+}
+
+// host returns the value recorded in the host column.
+func host() string {
+	return driver.Host()
+}
+
+// migrationError returns err, raised by the statement at index i of f,
+// as a *driver.MigrationError located at offset.
+func migrationError(f file.File, i, offset int, err error) error {
+	return driver.NewMigrationError(f, i, offset, "", err)
+}
+
+// milliseconds returns d rounded down to milliseconds.
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
 }
 
 func (driver *Driver) ensureVersionTableExists() error {
-	if _, err := driver.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version LONG PRIMARY KEY)", tableName)); err != nil {
+	if _, err := driver.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version LONG PRIMARY KEY)", driver.versionTable())); err != nil {
 		return err
 	}
+	return driver.addMissingColumns()
+}
+
+// versionColumns are the columns added to the version table over time.
+var versionColumns = []struct{ name, definition string }{
+	{"checksum", "STRING"},
+	{"dirty", "BOOLEAN"},
+	{"name", "STRING"},
+	{"applied_at", "TIMESTAMP"},
+	{"duration_ms", "LONG"},
+	{"host", "STRING"},
+}
+
+// addMissingColumns upgrades version tables created by older releases.
+func (driver *Driver) addMissingColumns() error {
+	schema := driver.table.Schema
+	if schema == "" {
+		schema = defaultSchema
+	}
+	for _, column := range versionColumns {
+		var c int
+		err := driver.db.QueryRow("SELECT count(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = ? AND column_name = ?", schema, driver.table.Name, column.name).Scan(&c)
+		if err != nil {
+			return err
+		}
+		if c > 0 {
+			continue
+		}
+		if _, err := driver.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", driver.versionTable(), column.name, column.definition)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/gemnasium/migrate/file"
 	"github.com/gemnasium/migrate/migrate/direction"
 	pipep "github.com/gemnasium/migrate/pipe"
+	"github.com/gemnasium/migrate/sqlsplit"
 )
 
 func TestContentSplit(t *testing.T) {
@@ -16,9 +17,16 @@ CREATE TABLE units (unit_id STRING primary key, name STRING, members array(strin
 CREATE TABLE available_connectors (technology_id STRING primary key, description STRING, icon STRING, link STRING, configuration_parameters array(object as (name STRING, type STRING))) CLUSTERED INTO 3 shards WITH (number_of_replicas = 0);
 	`
 
-	lines := splitContent(content)
-	if len(lines) != 3 {
-		t.Errorf("Expected 3 lines, but got %d", len(lines))
+	statements, err := sqlsplit.Split([]byte(content), sqlsplit.Crate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statements) != 3 {
+		t.Fatalf("Expected 3 lines, but got %d", len(statements))
+	}
+	var lines []string
+	for _, statement := range statements {
+		lines = append(lines, statement.Text)
 	}
 
 	if lines[0] != "CREATE TABLE users (user_id STRING primary key, first_name STRING, last_name STRING, email STRING, password_hash STRING) CLUSTERED INTO 3 shards WITH (number_of_replicas = 0)" {
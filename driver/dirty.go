@@ -0,0 +1,18 @@
+package driver
+
+import "github.com/gemnasium/migrate/file"
+
+// DirtyTracker is implemented by drivers flagging the migrations which
+// started but didn't complete. Their statements may have been partially
+// applied, leaving the database in an unknown state until it is fixed
+// by hand.
+type DirtyTracker interface {
+
+	// Dirty returns the versions flagged as dirty.
+	Dirty() (file.Versions, error)
+
+	// ClearDirty removes the dirty flag of version. If applied is true,
+	// version is kept as an applied migration, otherwise it's removed
+	// from the applied migrations.
+	ClearDirty(version file.Version, applied bool) error
+}
@@ -2,6 +2,7 @@
 package driver
 
 import (
+	"context"
 	"fmt"
 	neturl "net/url" // alias to allow `url string` func signature in New
 
@@ -28,6 +29,8 @@ type Driver interface {
 	// It will receive a file which the driver should apply
 	// to its backend or whatever. The migration function should use
 	// the pipe channel to return any errors or other useful information.
+	// Besides file.File, error and string values, drivers may send
+	// event.Event values to report richer progress information.
 	Migrate(file file.File, pipe chan interface{})
 
 	// Version returns the current migration version.
@@ -37,6 +40,14 @@ type Driver interface {
 	Versions() (file.Versions, error)
 }
 
+// ContextMigrator is implemented by drivers which can stop a
+// running migration. Once ctx is done, the statement currently
+// executed by the backend should be cancelled and the migration
+// rolled back where possible.
+type ContextMigrator interface {
+	MigrateContext(ctx context.Context, file file.File, pipe chan interface{})
+}
+
 // New returns Driver and calls Initialize on it.
 func New(url string) (Driver, error) {
 	u, err := neturl.Parse(url)
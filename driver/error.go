@@ -0,0 +1,69 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gemnasium/migrate/file"
+	"github.com/gemnasium/migrate/migrate/direction"
+)
+
+// MigrationError is the error drivers send when a statement of a
+// migration file fails, locating it in the file.
+type MigrationError struct {
+	// FileName, Version and Direction identify the migration file.
+	FileName  string
+	Version   file.Version
+	Direction direction.Direction
+
+	// Statement is the index of the failed statement among the statements
+	// of the file, starting at 0. Drivers running the whole file at once,
+	// and Go migrations, have a single statement.
+	Statement int
+
+	// Line and Column locate the error in the migration file, starting
+	// at 1, as returned by File.Position. They are zero if unknown, and
+	// so is Column if only the line is known.
+	Line, Column int
+
+	// Code is the error code of the backend, such as the SQLSTATE of
+	// Postgres, if any.
+	Code string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// NewMigrationError returns a MigrationError for err, raised by the
+// statement at index statement of f. offset is the byte offset in the
+// content of f the error points at, or -1 if unknown.
+func NewMigrationError(f file.File, statement, offset int, code string, err error) *MigrationError {
+	e := &MigrationError{
+		FileName:  f.FileName,
+		Version:   f.Version,
+		Direction: f.Direction,
+		Statement: statement,
+		Code:      code,
+		Err:       err,
+	}
+	if offset >= 0 && f.Func == nil {
+		e.Line, e.Column = f.Position(offset)
+	}
+	return e
+}
+
+func (e *MigrationError) Error() string {
+	var location strings.Builder
+	location.WriteString(e.FileName)
+	if e.Line > 0 {
+		fmt.Fprintf(&location, " line %d", e.Line)
+		if e.Column > 0 {
+			fmt.Fprintf(&location, " column %d", e.Column)
+		}
+	}
+	return fmt.Sprintf("%s: %v", location.String(), e.Err)
+}
+
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,46 @@
+package driver
+
+import (
+	"context"
+	"time"
+)
+
+// Locker is implemented by drivers able to prevent concurrent migration
+// runs against the same database, from any process or host.
+type Locker interface {
+
+	// Lock blocks until the migration lock is acquired.
+	// It must give up and return an error once ctx is done.
+	Lock(ctx context.Context) error
+
+	// Unlock releases the migration lock.
+	Unlock() error
+}
+
+// ForceUnlocker is implemented by Lockers whose lock outlives the
+// process holding it, such as a lock row left behind by a killed run.
+type ForceUnlocker interface {
+
+	// ForceUnlock releases the migration lock, whoever holds it.
+	ForceUnlock() error
+}
+
+// LockPollInterval is the time PollLock waits between two attempts.
+var LockPollInterval = 500 * time.Millisecond
+
+// PollLock calls tryLock until it reports the lock as acquired, it returns
+// an error or ctx is done. It helps drivers whose backend can't block
+// until a lock is released.
+func PollLock(ctx context.Context, tryLock func() (bool, error)) error {
+	for {
+		acquired, err := tryLock()
+		if err != nil || acquired {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(LockPollInterval):
+		}
+	}
+}
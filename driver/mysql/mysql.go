@@ -2,8 +2,8 @@
 package mysql
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
@@ -14,20 +14,37 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/event"
 	"github.com/gemnasium/migrate/file"
 	"github.com/gemnasium/migrate/migrate/direction"
+	"github.com/gemnasium/migrate/sqlsplit"
 	"github.com/go-sql-driver/mysql"
 )
 
 type Driver struct {
 	db *sql.DB
+
+	// lockConn holds the session owning the named lock
+	lockConn *sql.Conn
+
+	// table is the version table, see driver.ParseTable
+	table driver.Table
 }
 
-const tableName = "schema_migrations"
+const defaultTableName = "schema_migrations"
 
+// The table name and its database can be set with the
+// x-migrations-table and x-migrations-schema params.
 func (driver *Driver) Initialize(url string) error {
+	url, table, err := parseTable(url)
+	if err != nil {
+		return err
+	}
+	driver.table = table
+
 	urlWithoutScheme := strings.SplitN(url, "mysql://", 2)
 	if len(urlWithoutScheme) != 2 {
 		return errors.New("invalid mysql:// scheme")
@@ -84,21 +101,50 @@ func (driver *Driver) Close() error {
 }
 
 func (driver *Driver) ensureVersionTableExists() error {
-	_, err := driver.db.Exec("CREATE TABLE IF NOT EXISTS " + tableName + " (version bigint not null primary key);")
+	_, err := driver.db.Exec("CREATE TABLE IF NOT EXISTS " + driver.versionTable() + " (version bigint not null primary key);")
 
 	if err != nil {
 		return err
 	}
-	r := driver.db.QueryRow("SELECT data_type FROM information_schema.columns where table_name = ? and column_name = 'version'", tableName)
+	r := driver.db.QueryRow("SELECT data_type FROM information_schema.columns where table_schema = "+schemaOrCurrent+" and table_name = ? and column_name = 'version'", driver.table.Schema, driver.table.Name)
 	dataType := ""
 	if err := r.Scan(&dataType); err != nil {
 		return err
 	}
-	if dataType != "int" {
-		return nil
+	if dataType == "int" {
+		if _, err := driver.db.Exec("ALTER TABLE " + driver.versionTable() + " MODIFY version bigint"); err != nil {
+			return err
+		}
 	}
-	_, err = driver.db.Exec("ALTER TABLE " + tableName + " MODIFY version bigint")
-	return err
+	return driver.addMissingColumns()
+}
+
+// versionColumns are the columns added to the version table over time.
+var versionColumns = []struct{ name, definition string }{
+	{"checksum", "varchar(64)"},
+	{"dirty", "boolean not null default false"},
+	{"name", "varchar(255)"},
+	{"applied_at", "datetime(6)"},
+	{"duration_ms", "bigint"},
+	{"host", "varchar(255)"},
+}
+
+// addMissingColumns upgrades version tables created by older releases.
+func (driver *Driver) addMissingColumns() error {
+	for _, column := range versionColumns {
+		var c int
+		err := driver.db.QueryRow("SELECT count(*) FROM information_schema.columns WHERE table_schema = "+schemaOrCurrent+" AND table_name = ? AND column_name = ?", driver.table.Schema, driver.table.Name, column.name).Scan(&c)
+		if err != nil {
+			return err
+		}
+		if c > 0 {
+			continue
+		}
+		if _, err := driver.db.Exec("ALTER TABLE " + driver.versionTable() + " ADD COLUMN " + column.name + " " + column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (driver *Driver) FilenameExtension() string {
@@ -106,111 +152,263 @@ func (driver *Driver) FilenameExtension() string {
 }
 
 func (driver *Driver) Migrate(f file.File, pipe chan interface{}) {
+	driver.MigrateContext(context.Background(), f, pipe)
+}
+
+// MigrateContext is like Migrate, but kills the running statement with
+// KILL QUERY and rolls back the transaction once ctx is done.
+func (driver *Driver) MigrateContext(ctx context.Context, f file.File, pipe chan interface{}) {
 	defer close(pipe)
 	pipe <- f
+	start := time.Now()
+
+	checksum, err := f.Checksum()
+	if err != nil {
+		pipe <- err
+		return
+	}
+
+	// the mysql package doesn't run multiple statements per query:
+	// split them and run them one after the other.
+	statements, err := sqlsplit.Split(f.Content, sqlsplit.MySQL)
+	if err != nil {
+		pipe <- err
+		return
+	}
+
+	// MySQL commits DDL statements implicitly, so the transaction can't
+	// undo them: flag the version as dirty until the migration succeeds.
+	if err := driver.markDirty(ctx, f, checksum, start); err != nil {
+		pipe <- err
+		return
+	}
+
+	// committed is set once part of the migration may have been committed
+	// implicitly: the version is left dirty if the migration fails then,
+	// and the dirty flag is cleared otherwise. pending is set while the
+	// transaction holds changes a DDL statement would commit.
+	var committed, pending, ok bool
+	defer func() {
+		if !ok && !committed {
+			if err := driver.ClearDirty(f.Version, f.Direction == direction.Down); err != nil {
+				pipe <- err
+			}
+		}
+	}()
 
 	// http://go-database-sql.org/modifying.html, Working with Transactions
 	// You should not mingle the use of transaction-related functions such as Begin() and Commit() with SQL statements such as BEGIN and COMMIT in your SQL code.
-	tx, err := driver.db.Begin()
+	conn, err := driver.db.Conn(ctx)
 	if err != nil {
 		pipe <- err
 		return
 	}
+	defer conn.Close()
+	var connectionID int64
+	if err := conn.QueryRowContext(ctx, "SELECT CONNECTION_ID()").Scan(&connectionID); err != nil {
+		pipe <- err
+		return
+	}
+	defer driver.killQueryOnDone(ctx, connectionID, pipe)()
 
-	if f.Direction == direction.Up {
-		if _, err := tx.Exec("INSERT INTO "+tableName+" (version) VALUES (?)", f.Version); err != nil {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		pipe <- err
+		return
+	}
+
+	if f.Direction == direction.Down {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+driver.versionTable()+" WHERE version = ?", f.Version); err != nil {
 			pipe <- err
-			if err := tx.Rollback(); err != nil {
-				pipe <- err
-			}
+			committed = !rollback(tx, pipe)
 			return
 		}
-	} else if f.Direction == direction.Down {
-		if _, err := tx.Exec("DELETE FROM "+tableName+" WHERE version = ?", f.Version); err != nil {
+		pending = true
+	}
+
+	if f.Func != nil {
+		// Go migrations can run any statement
+		committed = true
+		if err := f.Func(ctx, tx); err != nil {
 			pipe <- err
-			if err := tx.Rollback(); err != nil {
-				pipe <- err
-			}
+			rollback(tx, pipe)
+			return
+		}
+	}
+
+	for i, statement := range statements {
+		implicitCommit := implicitCommitRegex.MatchString(statement.Text)
+		if implicitCommit && pending {
+			committed = true
+		}
+		if _, err := tx.ExecContext(ctx, statement.Text); err != nil {
+			pipe <- describeError(f, i, statement, err)
+			committed = !rollback(tx, pipe) || committed
+			return
+		}
+		if implicitCommit {
+			committed = true
+		}
+		pending = true
+		pipe <- event.Event{Kind: event.StatementExecuted, File: &f, Statement: statement.Text, Offset: statement.Offset}
+	}
+
+	if f.Direction == direction.Up {
+		if _, err := tx.ExecContext(ctx, "UPDATE "+driver.versionTable()+" SET dirty = false, duration_ms = ? WHERE version = ?", milliseconds(time.Since(start)), f.Version); err != nil {
+			pipe <- err
+			committed = !rollback(tx, pipe) || committed
 			return
 		}
 	}
 
-	if err := f.ReadContent(); err != nil {
+	if err := tx.Commit(); err != nil {
 		pipe <- err
+		committed = true
 		return
 	}
+	ok = true
+}
+
+// implicitCommitRegex matches the statements MySQL commits implicitly,
+// along with the statements run before them in the transaction, see
+// https://dev.mysql.com/doc/refman/8.0/en/implicit-commit.html
+var implicitCommitRegex = regexp.MustCompile(`(?i)^(?:ALTER|CREATE|DROP|RENAME|TRUNCATE|GRANT|REVOKE|SET\s+PASSWORD|LOCK|UNLOCK|INSTALL|UNINSTALL|ANALYZE|CACHE|CHECK|FLUSH|LOAD|OPTIMIZE|REPAIR|RESET|START|BEGIN|COMMIT)\b`)
+
+// errorLineRegex matches the line MySQL errors point at,
+// counted from the start of the failed statement.
+var errorLineRegex = regexp.MustCompile(`at line ([0-9]+)$`)
+
+// describeError returns err, raised by the statement at index i of f,
+// as a *driver.MigrationError. MySQL errors are located at the line they
+// point at, counted from the start of the file, with the lines around it.
+func describeError(f file.File, i int, statement sqlsplit.Statement, err error) error {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return driver.NewMigrationError(f, i, statement.Offset, "", err)
+	}
+	code := strconv.Itoa(int(mysqlErr.Number))
+	matches := errorLineRegex.FindStringSubmatch(mysqlErr.Message)
+	if len(matches) != 2 {
+		return driver.NewMigrationError(f, i, statement.Offset, code, mysqlErr)
+	}
+	lineNo, err := strconv.Atoi(matches[1])
+	if err != nil || lineNo < 1 {
+		return driver.NewMigrationError(f, i, statement.Offset, code, mysqlErr)
+	}
+
+	// offset of the line of the statement the error points at
+	offset := statement.Offset
+	for l := 1; l < lineNo; l++ {
+		next := bytes.IndexByte(f.Content[offset:], '\n')
+		if next < 0 {
+			break
+		}
+		offset += next + 1
+	}
+	e := driver.NewMigrationError(f, i, offset, code, nil)
+	e.Column = 0 // MySQL only reports the line
+
+	message := errorLineRegex.ReplaceAllString(mysqlErr.Error(), fmt.Sprintf("at line %v", e.Line))
+	contentLine, _ := file.LineColumnFromOffset(f.Content, offset)
+	errorPart := file.LinesBeforeAndAfter(f.Content, contentLine, 5, 5, true)
+	e.Err = driver.WithMessage(mysqlErr, fmt.Sprintf("%s\n\n%s", message, string(errorPart)))
+	return e
+}
 
-	// TODO this is not good! unfortunately there is no mysql driver that
-	// supports multiple statements per query.
-	sqlStmts := bytes.Split(f.Content, []byte(";"))
-
-	for _, sqlStmt := range sqlStmts {
-		sqlStmt = bytes.TrimSpace(sqlStmt)
-		if len(sqlStmt) > 0 {
-			if _, err := tx.Exec(string(sqlStmt)); err != nil {
-				mysqlErr, isErr := err.(*mysql.MySQLError)
-
-				if isErr {
-					re, err := regexp.Compile(`at line ([0-9]+)$`)
-					if err != nil {
-						pipe <- err
-						if err := tx.Rollback(); err != nil {
-							pipe <- err
-						}
-					}
-
-					var lineNo int
-					lineNoRe := re.FindStringSubmatch(mysqlErr.Message)
-					if len(lineNoRe) == 2 {
-						lineNo, err = strconv.Atoi(lineNoRe[1])
-					}
-					if err == nil {
-
-						// get white-space offset
-						// TODO this is broken, because we use sqlStmt instead of f.Content
-						wsLineOffset := 0
-						b := bufio.NewReader(bytes.NewBuffer(sqlStmt))
-						for {
-							line, _, err := b.ReadLine()
-							if err != nil {
-								break
-							}
-							if bytes.TrimSpace(line) == nil {
-								wsLineOffset += 1
-							} else {
-								break
-							}
-						}
-
-						message := mysqlErr.Error()
-						message = re.ReplaceAllString(message, fmt.Sprintf("at line %v", lineNo+wsLineOffset))
-
-						errorPart := file.LinesBeforeAndAfter(sqlStmt, lineNo, 5, 5, true)
-						pipe <- errors.New(fmt.Sprintf("%s\n\n%s", message, string(errorPart)))
-					} else {
-						pipe <- errors.New(mysqlErr.Error())
-					}
-
-					if err := tx.Rollback(); err != nil {
-						pipe <- err
-					}
-
-					return
-				}
+// markDirty records f's version as dirty before its migration runs. The
+// version of a failed run may still be there when f runs again.
+func (driver *Driver) markDirty(ctx context.Context, f file.File, checksum string, start time.Time) error {
+	var err error
+	if f.Direction == direction.Up {
+		_, err = driver.db.ExecContext(ctx, "INSERT INTO "+driver.versionTable()+" (version, checksum, name, host, applied_at, dirty) VALUES (?, ?, ?, ?, ?, true)"+
+			" ON DUPLICATE KEY UPDATE checksum = VALUES(checksum), name = VALUES(name), host = VALUES(host), applied_at = VALUES(applied_at), dirty = true", f.Version, checksum, f.Name, host(), start.UTC())
+	} else {
+		_, err = driver.db.ExecContext(ctx, "UPDATE "+driver.versionTable()+" SET dirty = true WHERE version = ?", f.Version)
+	}
+	return err
+}
+
+// killQueryOnDone kills the statement running on the connection
+// connectionID once ctx is done: closing the connection, as the mysql
+// package does, leaves it running on the server. The returned function
+// stops watching ctx, and must be called before the connection is
+// released so that the next statement run on it is not killed.
+func (driver *Driver) killQueryOnDone(ctx context.Context, connectionID int64, pipe chan interface{}) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			if _, err := driver.db.Exec(fmt.Sprintf("KILL QUERY %d", connectionID)); err != nil {
+				pipe <- fmt.Errorf("Unable to kill the running statement: %v", err)
 			}
+		case <-done:
 		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
 	}
+}
 
-	if err := tx.Commit(); err != nil {
+// rollback rolls back tx, reporting whether it succeeded. A transaction
+// already rolled back because its context was cancelled is not reported
+// as an error.
+func rollback(tx *sql.Tx, pipe chan interface{}) (ok bool) {
+	if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
 		pipe <- err
-		return
+		return false
+	}
+	return true
+}
+
+// Lock takes a named lock with GET_LOCK, scoped to the database of the
+// version table.
+// MySQL releases named locks when the session ends, so a crashed run
+// never leaves the lock behind.
+func (driver *Driver) Lock(ctx context.Context) error {
+	conn, err := driver.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	// GET_LOCK waits forever with a negative timeout
+	timeout := -1
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = int(time.Until(deadline)/time.Second) + 1
+	}
+
+	var acquired sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(CONCAT("+schemaOrCurrent+", '.', ?), ?)", driver.table.Schema, driver.table.Name, timeout).Scan(&acquired)
+	if err == nil && acquired.Int64 != 1 {
+		err = errors.New("Timeout while waiting for lock")
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	driver.lockConn = conn
+	return nil
+}
+
+// Unlock releases the named lock taken by Lock.
+func (driver *Driver) Unlock() error {
+	if driver.lockConn == nil {
+		return nil
 	}
+	defer func() {
+		driver.lockConn.Close()
+		driver.lockConn = nil
+	}()
+	_, err := driver.lockConn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(CONCAT("+schemaOrCurrent+", '.', ?))", driver.table.Schema, driver.table.Name)
+	return err
 }
 
 // Version returns the current migration version.
 func (driver *Driver) Version() (file.Version, error) {
 	var version file.Version
-	err := driver.db.QueryRow("SELECT version FROM " + tableName + " ORDER BY version DESC").Scan(&version)
+	err := driver.db.QueryRow("SELECT version FROM " + driver.versionTable() + " ORDER BY version DESC").Scan(&version)
 	switch {
 	case err == sql.ErrNoRows:
 		return 0, nil
@@ -225,7 +423,7 @@ func (driver *Driver) Version() (file.Version, error) {
 func (driver *Driver) Versions() (file.Versions, error) {
 	versions := file.Versions{}
 
-	rows, err := driver.db.Query("SELECT version FROM " + tableName + " ORDER BY version DESC")
+	rows, err := driver.db.Query("SELECT version FROM " + driver.versionTable() + " ORDER BY version DESC")
 	if err != nil {
 		return versions, err
 	}
@@ -242,6 +440,135 @@ func (driver *Driver) Versions() (file.Versions, error) {
 	return versions, err
 }
 
+// Checksums returns the checksums of the applied migrations.
+// Migrations applied before checksums were recorded are left out.
+func (driver *Driver) Checksums() (map[file.Version]string, error) {
+	checksums := make(map[file.Version]string)
+
+	rows, err := driver.db.Query("SELECT version, checksum FROM " + driver.versionTable())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version file.Version
+		var checksum sql.NullString
+		if err := rows.Scan(&version, &checksum); err != nil {
+			return nil, err
+		}
+		if checksum.Valid {
+			checksums[version] = checksum.String
+		}
+	}
+	return checksums, rows.Err()
+}
+
+// Records returns the applied migrations, newest first.
+func (driver *Driver) Records() ([]driver.Record, error) {
+	return readRecords(driver.db, driver.versionTable())
+}
+
+// Dirty returns the versions of the migrations which didn't complete.
+func (driver *Driver) Dirty() (file.Versions, error) {
+	versions := file.Versions{}
+
+	rows, err := driver.db.Query("SELECT version FROM " + driver.versionTable() + " WHERE dirty = true ORDER BY version DESC")
+	if err != nil {
+		return versions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version file.Version
+		if err := rows.Scan(&version); err != nil {
+			return versions, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// ClearDirty removes the dirty flag of version, removing version
+// altogether unless applied is true.
+func (driver *Driver) ClearDirty(version file.Version, applied bool) error {
+	var err error
+	if applied {
+		_, err = driver.db.Exec("UPDATE "+driver.versionTable()+" SET dirty = false WHERE version = ?", version)
+	} else {
+		_, err = driver.db.Exec("DELETE FROM "+driver.versionTable()+" WHERE version = ?", version)
+	}
+	return err
+}
+
+// Retryable reports whether err is a deadlock (error 1213) or a lock
+// wait timeout (error 1205). MySQL commits DDL statements implicitly,
+// so the driver doesn't implement driver.Transactional: only files with
+// the retries directive are run again.
+func (driver *Driver) Retryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+}
+
+// readRecords reads the version table into records.
+// Applied times are stored in UTC.
+func readRecords(db *sql.DB, table string) ([]driver.Record, error) {
+	records := []driver.Record{}
+
+	rows, err := db.Query("SELECT version, name, applied_at, duration_ms, host FROM " + table + " ORDER BY version DESC")
+	if err != nil {
+		return records, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version file.Version
+		var name, host sql.NullString
+		var appliedAt mysql.NullTime
+		var durationMs sql.NullInt64
+		if err := rows.Scan(&version, &name, &appliedAt, &durationMs, &host); err != nil {
+			return records, err
+		}
+		records = append(records, driver.Record{
+			Version:   version,
+			Name:      name.String,
+			AppliedAt: appliedAt.Time,
+			Duration:  time.Duration(durationMs.Int64) * time.Millisecond,
+			Host:      host.String,
+		})
+	}
+	return records, rows.Err()
+}
+
+// schemaOrCurrent is the SQL expression of the version table database,
+// given the schema as parameter.
+const schemaOrCurrent = "COALESCE(NULLIF(?, ''), DATABASE())"
+
+// parseTable reads the version table from url.
+func parseTable(url string) (string, driver.Table, error) {
+	return driver.ParseTable(url, defaultTableName)
+}
+
+// versionTable returns the version table name to use in queries.
+func (driver *Driver) versionTable() string {
+	return driver.table.QualifiedName(quoteIdentifier)
+}
+
+// quoteIdentifier quotes table and database names with backticks.
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// host returns the value recorded in the host column.
+func host() string {
+	return driver.Host()
+}
+
+// milliseconds returns d rounded down to milliseconds.
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
 func init() {
-	driver.RegisterDriver("mysql", &Driver{})
+	driver.RegisterFactory("mysql", func() driver.Driver { return &Driver{} })
 }
@@ -32,7 +32,7 @@ func TestMigrate(t *testing.T) {
 	dropTestTables(t, connection)
 
 	// Make an old-style 32-bit int version column that we'll have to upgrade.
-	_, err = connection.Exec("CREATE TABLE IF NOT EXISTS " + tableName + " (version int not null primary key);")
+	_, err = connection.Exec("CREATE TABLE IF NOT EXISTS " + defaultTableName + " (version int not null primary key);")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -137,13 +137,46 @@ func migrate(t *testing.T, driverURL string) {
 		t.Errorf("Expected versions to be: %v, got: %v", expectedVersions, versions)
 	}
 
+	// the failed migration was rolled back entirely: it isn't dirty
+	dirty, err := d.Dirty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirty) != 0 {
+		t.Errorf("Expected no dirty version, got: %v", dirty)
+	}
+
+	// a table was created before the error: the version stays dirty
+	pipe = pipep.New()
+	go d.Migrate(file.File{
+		Path:      "/foobar",
+		FileName:  "20080000000000_foobar.up.sql",
+		Version:   20080000000000,
+		Name:      "foobar",
+		Direction: direction.Up,
+		Content:   []byte("CREATE TABLE yolo2 (id int);\nCREATE TABLE error (id THIS WILL CAUSE AN ERROR);"),
+	}, pipe)
+	if errs := pipep.ReadErrors(pipe); len(errs) == 0 {
+		t.Error("Expected test case to fail")
+	}
+	dirty, err = d.Dirty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dirty, file.Versions{20080000000000}) {
+		t.Errorf("Expected version 20080000000000 to be dirty, got: %v", dirty)
+	}
+	if err := d.ClearDirty(20080000000000, false); err != nil {
+		t.Fatal(err)
+	}
+
 	if err := d.Close(); err != nil {
 		t.Fatal(err)
 	}
 }
 
 func dropTestTables(t *testing.T, db *sql.DB) {
-	if _, err := db.Exec(`DROP TABLE IF EXISTS yolo, yolo1, ` + tableName); err != nil {
+	if _, err := db.Exec(`DROP TABLE IF EXISTS yolo, yolo1, yolo2, ` + defaultTableName); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -2,26 +2,60 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	neturl "net/url" // alias to allow `url string` func signature in Initialize
+	"regexp"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/event"
 	"github.com/gemnasium/migrate/file"
 	"github.com/gemnasium/migrate/migrate/direction"
+	"github.com/gemnasium/migrate/sqlsplit"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 )
 
 type Driver struct {
 	db *sqlx.DB
+
+	// table is the version table, see driver.ParseTable
+	table driver.Table
+
+	// lockConn holds the session owning the advisory lock
+	lockConn *sql.Conn
 }
 
-const tableName = "schema_migrations"
-const txDisabledOption = "disable_ddl_transaction"
+const defaultTableName = "schema_migrations"
 
+// The table name and its schema can be set with the
+// x-migrations-table and x-migrations-schema params.
+//
+// The schema param sets the search_path of the migration sessions,
+// so that migrations and the version table go to that schema.
+// It is created first if the create_schema param is true.
+//
+// Example:
+// postgres://host/db?schema=tenant1&create_schema=true
 func (driver *Driver) Initialize(url string) error {
+	url, table, err := parseTable(url)
+	if err != nil {
+		return err
+	}
+	url, schema, createSchema, err := parseSchema(url)
+	if err != nil {
+		return err
+	}
+	if table.Schema == "" {
+		table.Schema = schema
+	}
+	driver.table = table
+
 	db, err := sqlx.Open("postgres", url)
 	if err != nil {
 		return err
@@ -31,11 +65,52 @@ func (driver *Driver) Initialize(url string) error {
 	}
 	driver.db = db
 
+	if createSchema {
+		if _, err := db.Exec("CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(schema)); err != nil {
+			return err
+		}
+	}
 	return driver.ensureVersionTableExists()
 }
 
+// parseSchema removes the schema and create_schema params from rawurl,
+// replacing them with the search_path run-time parameter, which pq sets
+// on every connection.
+func parseSchema(rawurl string) (string, string, bool, error) {
+	u, err := neturl.Parse(rawurl)
+	if err != nil {
+		return "", "", false, err
+	}
+	q := u.Query()
+	schema := q.Get("schema")
+	createSchema := false
+	if v := q.Get("create_schema"); v != "" {
+		if createSchema, err = strconv.ParseBool(v); err != nil {
+			return "", "", false, fmt.Errorf("Invalid create_schema param: %v", err)
+		}
+	}
+	if _, ok := q["schema"]; !ok {
+		if createSchema {
+			return "", "", false, fmt.Errorf("create_schema requires the schema param")
+		}
+		return rawurl, "", false, nil
+	}
+	if schema == "" {
+		return "", "", false, fmt.Errorf("Empty value for url parameter schema")
+	}
+
+	q.Del("schema")
+	q.Del("create_schema")
+	q.Set("search_path", pq.QuoteIdentifier(schema))
+	u.RawQuery = q.Encode()
+	return u.String(), schema, createSchema, nil
+}
+
 func (driver *Driver) SetDB(db *sql.DB) {
 	driver.db = sqlx.NewDb(db, "postgres")
+	if driver.table.Name == "" {
+		driver.table.Name = defaultTableName
+	}
 }
 
 func (driver *Driver) Close() error {
@@ -45,26 +120,58 @@ func (driver *Driver) Close() error {
 func (driver *Driver) ensureVersionTableExists() error {
 	// avoid DDL statements if possible for BDR (see #23)
 	var c int
-	driver.db.Get(&c, "SELECT count(*) FROM information_schema.tables WHERE table_name = $1;", tableName)
+	driver.db.Get(&c, "SELECT count(*) FROM information_schema.tables WHERE table_schema = "+schemaOrCurrent+" AND table_name = $1;", driver.table.Name, driver.table.Schema)
 	if c > 0 {
 		// table schema_migrations already exists, check if the schema is correct, ie: version is a bigint
 
 		var dataType string
-		err := driver.db.Get(&dataType, "SELECT data_type FROM information_schema.columns where table_name = $1 and column_name = 'version'", tableName)
+		err := driver.db.Get(&dataType, "SELECT data_type FROM information_schema.columns where table_schema = "+schemaOrCurrent+" and table_name = $1 and column_name = 'version'", driver.table.Name, driver.table.Schema)
 		if err != nil {
 			return err
 		}
 
-		if dataType == "bigint" {
-			return nil
+		if dataType != "bigint" {
+			_, err = driver.db.Exec("ALTER TABLE " + driver.versionTable() + " ALTER COLUMN version TYPE bigint USING version::bigint")
+			if err != nil {
+				return err
+			}
 		}
 
-		_, err = driver.db.Exec("ALTER TABLE " + tableName + " ALTER COLUMN version TYPE bigint USING version::bigint")
+		return driver.addMissingColumns()
+	}
+
+	if _, err := driver.db.Exec("CREATE TABLE IF NOT EXISTS " + driver.versionTable() + " (version bigint not null primary key);"); err != nil {
 		return err
 	}
+	return driver.addMissingColumns()
+}
 
-	_, err := driver.db.Exec("CREATE TABLE IF NOT EXISTS " + tableName + " (version bigint not null primary key);")
-	return err
+// versionColumns are the columns added to the version table over time.
+var versionColumns = []struct{ name, definition string }{
+	{"checksum", "varchar(64)"},
+	{"dirty", "boolean not null default false"},
+	{"name", "varchar(255)"},
+	{"applied_at", "timestamp with time zone"},
+	{"duration_ms", "bigint"},
+	{"host", "varchar(255)"},
+}
+
+// addMissingColumns upgrades version tables created by older releases.
+func (driver *Driver) addMissingColumns() error {
+	for _, column := range versionColumns {
+		var c int
+		err := driver.db.Get(&c, "SELECT count(*) FROM information_schema.columns WHERE table_schema = "+schemaOrCurrent+" AND table_name = $1 AND column_name = $3", driver.table.Name, driver.table.Schema, column.name)
+		if err != nil {
+			return err
+		}
+		if c > 0 {
+			continue
+		}
+		if _, err := driver.db.Exec("ALTER TABLE " + driver.versionTable() + " ADD COLUMN " + column.name + " " + column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (driver *Driver) FilenameExtension() string {
@@ -72,71 +179,201 @@ func (driver *Driver) FilenameExtension() string {
 }
 
 func (driver *Driver) Migrate(f file.File, pipe chan interface{}) {
+	driver.MigrateContext(context.Background(), f, pipe)
+}
+
+// MigrateContext is like Migrate, but cancels the running statement
+// and rolls back the transaction once ctx is done.
+func (driver *Driver) MigrateContext(ctx context.Context, f file.File, pipe chan interface{}) {
 	defer close(pipe)
 	pipe <- f
 
-	tx, err := driver.db.Begin()
+	inTx, err := runsInTransaction(f)
 	if err != nil {
 		pipe <- err
 		return
 	}
+	if !inTx {
+		driver.migrate(ctx, nil, f, pipe)
+		return
+	}
 
-	if f.Direction == direction.Up {
-		if _, err := tx.Exec("INSERT INTO "+tableName+" (version) VALUES ($1)", f.Version); err != nil {
-			pipe <- err
-			if err := tx.Rollback(); err != nil {
-				pipe <- err
-			}
-			return
-		}
-	} else if f.Direction == direction.Down {
-		if _, err := tx.Exec("DELETE FROM "+tableName+" WHERE version=$1", f.Version); err != nil {
-			pipe <- err
-			if err := tx.Rollback(); err != nil {
-				pipe <- err
-			}
-			return
-		}
+	tx, err := driver.db.BeginTx(ctx, nil)
+	if err != nil {
+		pipe <- err
+		return
+	}
+	if ok := driver.migrate(ctx, tx, f, pipe); !ok {
+		rollback(tx, pipe)
+		return
 	}
+	if err := tx.Commit(); err != nil {
+		pipe <- err
+		return
+	}
+}
 
-	if err := f.ReadContent(); err != nil {
+// BeginTx starts a transaction for MigrateTx.
+func (driver *Driver) BeginTx(ctx context.Context) (driver.Tx, error) {
+	tx, err := driver.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// MigrateTx runs f in tx, or outside of a transaction if tx is nil.
+func (driver *Driver) MigrateTx(ctx context.Context, tx driver.Tx, f file.File, pipe chan interface{}) {
+	defer close(pipe)
+	pipe <- f
+
+	inTx, err := runsInTransaction(f)
+	if err != nil {
 		pipe <- err
 		return
 	}
+	if tx != nil && !inTx {
+		pipe <- fmt.Errorf("%s can't run in a transaction", f.FileName)
+		return
+	}
+	driver.migrate(ctx, tx, f, pipe)
+}
+
+// migrate runs f and records its version in tx. If tx is nil, statements
+// run outside of a transaction can't be rolled back: the version is
+// flagged as dirty until they all succeed.
+func (driver *Driver) migrate(ctx context.Context, tx driver.Tx, f file.File, pipe chan interface{}) (ok bool) {
+	start := time.Now()
+	checksum, err := f.Checksum()
+	if err != nil {
+		pipe <- err
+		return false
+	}
 
-	if txDisabled(fileOptions(f.Content)) {
-		_, err = driver.db.Exec(string(f.Content))
+	var exec file.Tx = tx
+	if tx == nil {
+		exec = driver.db
+		err = driver.markDirty(ctx, f, checksum, start)
+	} else if f.Direction == direction.Up {
+		_, err = tx.ExecContext(ctx, "INSERT INTO "+driver.versionTable()+" (version, checksum, name, host, applied_at) VALUES ($1, $2, $3, $4, $5)", f.Version, checksum, f.Name, host(), start)
+	} else if f.Direction == direction.Down {
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+driver.versionTable()+" WHERE version=$1", f.Version)
+	}
+	if err != nil {
+		pipe <- err
+		return false
+	}
+
+	if f.Func != nil {
+		err = f.Func(ctx, exec)
 	} else {
-		_, err = tx.Exec(string(f.Content))
+		_, err = exec.ExecContext(ctx, string(f.Content))
+	}
+	if err != nil {
+		pipe <- describeError(f, err)
+		return false
+	}
+	if f.Func == nil {
+		pipe <- event.Event{Kind: event.StatementExecuted, File: &f, Statement: string(f.Content)}
 	}
 
+	if f.Direction == direction.Up {
+		_, err = exec.ExecContext(ctx, "UPDATE "+driver.versionTable()+" SET dirty = false, duration_ms = $2 WHERE version=$1", f.Version, milliseconds(time.Since(start)))
+	} else if tx == nil {
+		_, err = exec.ExecContext(ctx, "DELETE FROM "+driver.versionTable()+" WHERE version=$1", f.Version)
+	}
 	if err != nil {
-		pqErr := err.(*pq.Error)
-		offset, err := strconv.Atoi(pqErr.Position)
-		if err == nil && offset >= 0 {
-			lineNo, columnNo := file.LineColumnFromOffset(f.Content, offset-1)
-			errorPart := file.LinesBeforeAndAfter(f.Content, lineNo, 5, 5, true)
-			pipe <- fmt.Errorf("%s %v: %s in line %v, column %v:\n\n%s", pqErr.Severity, pqErr.Code, pqErr.Message, lineNo, columnNo, string(errorPart))
-		} else {
-			pipe <- fmt.Errorf("%s %v: %s", pqErr.Severity, pqErr.Code, pqErr.Message)
-		}
+		pipe <- err
+		return false
+	}
+	return true
+}
 
-		if err := tx.Rollback(); err != nil {
-			pipe <- err
-		}
-		return
+// describeError returns err as a *driver.MigrationError, located at
+// the position Postgres reports, with the lines around it.
+func describeError(f file.File, err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return driver.NewMigrationError(f, 0, -1, "", err)
+	}
+	message := fmt.Sprintf("%s %v: %s", pqErr.Severity, pqErr.Code, pqErr.Message)
+	position, convErr := strconv.Atoi(pqErr.Position)
+	if convErr != nil || position < 1 {
+		return driver.NewMigrationError(f, 0, -1, string(pqErr.Code), driver.WithMessage(pqErr, message))
+	}
+	// Postgres counts characters from 1, not bytes
+	offset := len(f.Content)
+	if runes := []rune(string(f.Content)); position-1 < len(runes) {
+		offset = len(string(runes[:position-1]))
 	}
+	lineNo, _ := file.LineColumnFromOffset(f.Content, offset)
+	errorPart := file.LinesBeforeAndAfter(f.Content, lineNo, 5, 5, true)
+	return driver.NewMigrationError(f, 0, offset, string(pqErr.Code), driver.WithMessage(pqErr, fmt.Sprintf("%s:\n\n%s", message, errorPart)))
+}
 
-	if err := tx.Commit(); err != nil {
+// markDirty records f's version as dirty before its migration runs. The
+// version of a failed run may still be there when f runs again.
+func (driver *Driver) markDirty(ctx context.Context, f file.File, checksum string, start time.Time) error {
+	var err error
+	if f.Direction == direction.Up {
+		_, err = driver.db.ExecContext(ctx, "INSERT INTO "+driver.versionTable()+" (version, checksum, name, host, applied_at, dirty) VALUES ($1, $2, $3, $4, $5, true)"+
+			" ON CONFLICT (version) DO UPDATE SET checksum = EXCLUDED.checksum, name = EXCLUDED.name, host = EXCLUDED.host, applied_at = EXCLUDED.applied_at, dirty = true", f.Version, checksum, f.Name, host(), start)
+	} else {
+		_, err = driver.db.ExecContext(ctx, "UPDATE "+driver.versionTable()+" SET dirty = true WHERE version=$1", f.Version)
+	}
+	return err
+}
+
+// rollback rolls back tx. A transaction already rolled back
+// because its context was cancelled is not reported as an error.
+func rollback(tx *sql.Tx, pipe chan interface{}) {
+	if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
 		pipe <- err
-		return
 	}
 }
 
+// Lock takes a session level advisory lock. Advisory locks are
+// released by Postgres when the session ends, so a crashed run
+// never leaves the lock behind.
+func (driver *Driver) Lock(ctx context.Context) error {
+	conn, err := driver.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey(driver.table)); err != nil {
+		conn.Close()
+		return err
+	}
+	driver.lockConn = conn
+	return nil
+}
+
+// Unlock releases the advisory lock taken by Lock.
+func (driver *Driver) Unlock() error {
+	if driver.lockConn == nil {
+		return nil
+	}
+	defer func() {
+		driver.lockConn.Close()
+		driver.lockConn = nil
+	}()
+	_, err := driver.lockConn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey(driver.table))
+	return err
+}
+
+// lockKey returns the advisory lock key, derived from the version table name.
+func lockKey(table driver.Table) int64 {
+	name := table.Name
+	if table.Schema != "" {
+		name = table.Schema + "." + name
+	}
+	return int64(crc32.ChecksumIEEE([]byte(name)))
+}
+
 // Version returns the current migration version.
 func (driver *Driver) Version() (file.Version, error) {
 	var version file.Version
-	err := driver.db.Get(&version, "SELECT version FROM "+tableName+" ORDER BY version DESC LIMIT 1")
+	err := driver.db.Get(&version, "SELECT version FROM "+driver.versionTable()+" ORDER BY version DESC LIMIT 1")
 	if err == sql.ErrNoRows {
 		return version, nil
 	}
@@ -147,30 +384,200 @@ func (driver *Driver) Version() (file.Version, error) {
 // Versions returns the list of applied migrations.
 func (driver *Driver) Versions() (file.Versions, error) {
 	versions := file.Versions{}
-	err := driver.db.Select(&versions, "SELECT version FROM "+tableName+" ORDER BY version DESC")
+	err := driver.db.Select(&versions, "SELECT version FROM "+driver.versionTable()+" ORDER BY version DESC")
 	return versions, err
 }
 
-// fileOptions returns the list of options extracted from the first line of the file content.
-// Format: "-- <option1> <option2> <...>"
-func fileOptions(content []byte) []string {
-	firstLine := strings.Split(string(content), "\n")[0]
-	if !strings.HasPrefix(firstLine, "-- ") {
-		return []string{}
+// Checksums returns the checksums of the applied migrations.
+// Migrations applied before checksums were recorded are left out.
+func (driver *Driver) Checksums() (map[file.Version]string, error) {
+	rows := []struct {
+		Version  file.Version
+		Checksum sql.NullString
+	}{}
+	if err := driver.db.Select(&rows, "SELECT version, checksum FROM "+driver.versionTable()); err != nil {
+		return nil, err
 	}
-	opts := strings.TrimPrefix(firstLine, "-- ")
-	return strings.Split(opts, " ")
+	checksums := make(map[file.Version]string, len(rows))
+	for _, row := range rows {
+		if row.Checksum.Valid {
+			checksums[row.Version] = row.Checksum.String
+		}
+	}
+	return checksums, nil
 }
 
-func txDisabled(opts []string) bool {
-	for _, v := range opts {
-		if v == txDisabledOption {
-			return true
-		}
+// Records returns the applied migrations, newest first.
+func (driver *Driver) Records() ([]driver.Record, error) {
+	return readRecords(driver.db, driver.versionTable())
+}
+
+// readRecords reads the version table into records.
+func readRecords(db *sqlx.DB, table string) ([]driver.Record, error) {
+	rows := []struct {
+		Version    file.Version
+		Name       sql.NullString
+		AppliedAt  pq.NullTime   `db:"applied_at"`
+		DurationMs sql.NullInt64 `db:"duration_ms"`
+		Host       sql.NullString
+	}{}
+	if err := db.Select(&rows, "SELECT version, name, applied_at, duration_ms, host FROM "+table+" ORDER BY version DESC"); err != nil {
+		return nil, err
+	}
+	records := make([]driver.Record, 0, len(rows))
+	for _, row := range rows {
+		records = append(records, driver.Record{
+			Version:   row.Version,
+			Name:      row.Name.String,
+			AppliedAt: row.AppliedAt.Time,
+			Duration:  time.Duration(row.DurationMs.Int64) * time.Millisecond,
+			Host:      row.Host.String,
+		})
+	}
+	return records, nil
+}
+
+// Dirty returns the versions of the migrations run outside of a
+// transaction which didn't complete.
+func (driver *Driver) Dirty() (file.Versions, error) {
+	versions := file.Versions{}
+	err := driver.db.Select(&versions, "SELECT version FROM "+driver.versionTable()+" WHERE dirty ORDER BY version DESC")
+	return versions, err
+}
+
+// ClearDirty removes the dirty flag of version, removing version
+// altogether unless applied is true.
+func (driver *Driver) ClearDirty(version file.Version, applied bool) error {
+	var err error
+	if applied {
+		_, err = driver.db.Exec("UPDATE "+driver.versionTable()+" SET dirty = false WHERE version=$1", version)
+	} else {
+		_, err = driver.db.Exec("DELETE FROM "+driver.versionTable()+" WHERE version=$1", version)
+	}
+	return err
+}
+
+// Retryable reports whether err is a serialization failure, a deadlock
+// or a lock which couldn't be acquired in time.
+func (driver *Driver) Retryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code.Name() {
+	case "serialization_failure", "deadlock_detected", "lock_not_available":
+		return true
 	}
 	return false
 }
 
+// InTransaction reports whether f runs in a transaction, which is the
+// case unless it has the no-transaction directive or its statement
+// can't run in a transaction block.
+func (driver *Driver) InTransaction(f file.File) bool {
+	inTx, err := runsInTransaction(f)
+	return err == nil && inTx
+}
+
+// Check returns an error if a statement of f can't run in a transaction
+// block but isn't alone in f, or if f has the no-transaction directive
+// and several statements.
+func (driver *Driver) Check(f file.File) error {
+	_, err := runsInTransaction(f)
+	return err
+}
+
+// nonTransactionalStatements are the statements Postgres refuses to run
+// in a transaction block, or in a multi-command string (SQLSTATE 25001).
+var nonTransactionalStatements = []struct {
+	name  string
+	regex *regexp.Regexp
+}{
+	{"CREATE INDEX CONCURRENTLY", regexp.MustCompile(`(?i)^CREATE\s+(?:UNIQUE\s+)?INDEX\s+CONCURRENTLY\b`)},
+	{"DROP INDEX CONCURRENTLY", regexp.MustCompile(`(?i)^DROP\s+INDEX\s+CONCURRENTLY\b`)},
+	{"REINDEX CONCURRENTLY", regexp.MustCompile(`(?is)^REINDEX\b.*\bCONCURRENTLY\b`)},
+	{"ALTER TABLE DETACH PARTITION CONCURRENTLY", regexp.MustCompile(`(?is)^ALTER\s+TABLE\b.*\bDETACH\s+PARTITION\b.*\bCONCURRENTLY\b`)},
+	{"ALTER TYPE ADD VALUE", regexp.MustCompile(`(?is)^ALTER\s+TYPE\b.*\bADD\s+VALUE\b`)},
+	{"VACUUM", regexp.MustCompile(`(?i)^VACUUM\b`)},
+	{"CREATE DATABASE", regexp.MustCompile(`(?i)^CREATE\s+DATABASE\b`)},
+	{"DROP DATABASE", regexp.MustCompile(`(?i)^DROP\s+DATABASE\b`)},
+	{"CREATE TABLESPACE", regexp.MustCompile(`(?i)^CREATE\s+TABLESPACE\b`)},
+	{"DROP TABLESPACE", regexp.MustCompile(`(?i)^DROP\s+TABLESPACE\b`)},
+	{"ALTER SYSTEM", regexp.MustCompile(`(?i)^ALTER\s+SYSTEM\b`)},
+}
+
+// nonTransactional returns the name of statement if it can't run in
+// a transaction block, or "".
+func nonTransactional(statement string) string {
+	for _, s := range nonTransactionalStatements {
+		if s.regex.MatchString(statement) {
+			return s.name
+		}
+	}
+	return ""
+}
+
+// runsInTransaction reports whether f runs in a transaction: unless it
+// has the no-transaction directive, or its statement can't run in one.
+// Postgres runs the statements of a file as a single multi-command
+// string, so statements run outside of a transaction must be alone in
+// their file: runsInTransaction returns an error otherwise. Files which
+// can't be split into statements are left to Postgres.
+func runsInTransaction(f file.File) (bool, error) {
+	directives, err := f.Directives()
+	if err != nil {
+		return false, err
+	}
+	if f.Func != nil {
+		return !directives.NoTransaction, nil
+	}
+	statements, err := sqlsplit.Split(f.Content, sqlsplit.Postgres)
+	if err != nil {
+		return !directives.NoTransaction, nil
+	}
+
+	for i, statement := range statements {
+		name := nonTransactional(statement.Text)
+		if name == "" {
+			continue
+		}
+		if len(statements) > 1 {
+			return false, driver.NewMigrationError(f, i, statement.Offset, "",
+				fmt.Errorf("%s can't run in a transaction nor along with other statements, move it to a migration file of its own", name))
+		}
+		return false, nil
+	}
+	if directives.NoTransaction && len(statements) > 1 {
+		return false, driver.NewMigrationError(f, 1, statements[1].Offset, "",
+			fmt.Errorf("files with the no-transaction directive can only hold a single statement, found %d", len(statements)))
+	}
+	return !directives.NoTransaction, nil
+}
+
+// schemaOrCurrent is the SQL expression of the version table schema in
+// information_schema lookups, given the schema as second parameter.
+const schemaOrCurrent = "COALESCE(NULLIF($2::text, ''), current_schema())"
+
+// parseTable reads the version table from url.
+func parseTable(url string) (string, driver.Table, error) {
+	return driver.ParseTable(url, defaultTableName)
+}
+
+// versionTable returns the version table name to use in queries.
+func (driver *Driver) versionTable() string {
+	return driver.table.QualifiedName(pq.QuoteIdentifier)
+}
+
+// host returns the value recorded in the host column.
+func host() string {
+	return driver.Host()
+}
+
+// milliseconds returns d rounded down to milliseconds.
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
 func init() {
-	driver.RegisterDriver("postgres", &Driver{})
+	driver.RegisterFactory("postgres", func() driver.Driver { return &Driver{} })
 }
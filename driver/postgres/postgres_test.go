@@ -31,7 +31,7 @@ func TestMigrate(t *testing.T) {
 	dropTestTables(t, connection)
 
 	// Make an old-style `int` version column that we'll have to upgrade.
-	_, err = connection.Exec("CREATE TABLE IF NOT EXISTS " + tableName + " (version int not null primary key)")
+	_, err = connection.Exec("CREATE TABLE IF NOT EXISTS " + defaultTableName + " (version int not null primary key)")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -196,8 +196,79 @@ func dropTestTables(t *testing.T, db *sql.DB) {
 	if _, err := db.Exec(`
 				DROP TYPE IF EXISTS colors;
 				DROP TABLE IF EXISTS yolo;
-				DROP TABLE IF EXISTS ` + tableName + `;`); err != nil {
+				DROP TABLE IF EXISTS ` + defaultTableName + `;`); err != nil {
 		t.Fatal(err)
 	}
 
 }
+
+func TestParseSchema(t *testing.T) {
+	var tests = []struct {
+		url          string
+		expectURL    string
+		expectSchema string
+		expectCreate bool
+		expectErr    bool
+	}{
+		{"postgres://host/db?sslmode=disable", "postgres://host/db?sslmode=disable", "", false, false},
+		{"postgres://host/db?schema=tenant1", "postgres://host/db?search_path=%22tenant1%22", "tenant1", false, false},
+		{"postgres://host/db?sslmode=disable&schema=Tenant1&create_schema=true", "postgres://host/db?search_path=%22Tenant1%22&sslmode=disable", "Tenant1", true, false},
+		{"postgres://host/db?schema=", "", "", false, true},
+		{"postgres://host/db?create_schema=true", "", "", false, true},
+		{"postgres://host/db?schema=tenant1&create_schema=maybe", "", "", false, true},
+	}
+
+	for _, test := range tests {
+		url, schema, create, err := parseSchema(test.url)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("parseSchema(%q): expected error, got none", test.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSchema(%q): unexpected error: %v", test.url, err)
+			continue
+		}
+		if url != test.expectURL || schema != test.expectSchema || create != test.expectCreate {
+			t.Errorf("parseSchema(%q): expected %q, %q, %v, got %q, %q, %v", test.url, test.expectURL, test.expectSchema, test.expectCreate, url, schema, create)
+		}
+	}
+}
+
+func TestRunsInTransaction(t *testing.T) {
+	var tests = []struct {
+		content    string
+		expectInTx bool
+		expectErr  string
+	}{
+		{"CREATE TABLE a (id int);\nCREATE INDEX a_id ON a (id);", true, ""},
+		{"-- create the index\ncreate unique index concurrently a_id on a (id);", false, ""},
+		{"ALTER TYPE colors ADD VALUE 'blue';", false, ""},
+		{"VACUUM ANALYZE a;", false, ""},
+		{"-- migrate:no-transaction\nUPDATE a SET id = 1;", false, ""},
+		{"CREATE FUNCTION f() RETURNS void AS $$ BEGIN VACUUM; END $$ LANGUAGE plpgsql;", true, ""},
+		{"CREATE TABLE a (id int);\n  CREATE INDEX CONCURRENTLY a_id ON a (id);", false,
+			"1_a.up.sql line 2 column 3: CREATE INDEX CONCURRENTLY can't run in a transaction nor along with other statements, move it to a migration file of its own"},
+		{"-- migrate:no-transaction\nUPDATE a SET id = 1;\nUPDATE a SET id = 2;", false,
+			"1_a.up.sql line 3 column 1: files with the no-transaction directive can only hold a single statement, found 2"},
+	}
+
+	for _, test := range tests {
+		f := file.File{FileName: "1_a.up.sql", Version: 1, Direction: direction.Up, Content: []byte(test.content)}
+		inTx, err := runsInTransaction(f)
+		if test.expectErr != "" {
+			if err == nil || err.Error() != test.expectErr {
+				t.Errorf("%q: expected error %q, got %v", test.content, test.expectErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.content, err)
+			continue
+		}
+		if inTx != test.expectInTx {
+			t.Errorf("%q: expected in transaction %v, got %v", test.content, test.expectInTx, inTx)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package driver
+
+import (
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/gemnasium/migrate/file"
+)
+
+// Record holds what the version table knows about an applied migration.
+// Migrations applied by older releases only have a Version.
+type Record struct {
+	Version file.Version
+
+	// Name is the migration name parsed from the file name.
+	Name string
+
+	// AppliedAt is the time the migration started.
+	AppliedAt time.Time
+
+	// Duration is the time it took to run the migration.
+	Duration time.Duration
+
+	// Host identifies who applied the migration, as user@hostname.
+	Host string
+}
+
+// RecordReader is implemented by drivers recording details
+// about each applied migration in their version table.
+type RecordReader interface {
+
+	// Records returns the applied migrations, newest first.
+	Records() ([]Record, error)
+}
+
+// Host returns the value drivers record as Record.Host
+// for the migrations applied by this process.
+func Host() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username + "@" + hostname
+	}
+	return hostname
+}
@@ -1,33 +1,51 @@
 package driver
 
 import (
+	"reflect"
 	"sort"
 	"sync"
 )
 
 var driversMu sync.Mutex
-var drivers = make(map[string]Driver)
+var drivers = make(map[string]Factory)
+
+// Factory returns a new driver, not initialized yet.
+type Factory func() Driver
 
 // Registers a driver so it can be created from its name. Drivers should call
 // this from an init() function so that they registers themselves on import.
+// New returns driver itself for every url: drivers holding a connection
+// should use RegisterFactory instead.
 func RegisterDriver(name string, driver Driver) {
-	driversMu.Lock()
-	defer driversMu.Unlock()
 	if driver == nil {
 		panic("driver: Register driver is nil")
 	}
+	RegisterFactory(name, func() Driver { return driver })
+}
+
+// RegisterFactory registers a driver so it can be created from its name,
+// New calling factory to get a driver of its own for every url.
+func RegisterFactory(name string, factory Factory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if factory == nil {
+		panic("driver: Register factory is nil")
+	}
 	if _, dup := drivers[name]; dup {
 		panic("sql: Register called twice for driver " + name)
 	}
-	drivers[name] = driver
+	drivers[name] = factory
 }
 
 // Retrieves a registered driver by name.
 func GetDriver(name string) Driver {
 	driversMu.Lock()
 	defer driversMu.Unlock()
-	driver := drivers[name]
-	return driver
+	factory := drivers[name]
+	if factory == nil {
+		return nil
+	}
+	return factory()
 }
 
 // Drivers returns a sorted list of the names of the registered drivers.
@@ -41,3 +59,16 @@ func Drivers() []string {
 	sort.Strings(list)
 	return list
 }
+
+// Name returns the name the driver type of d was registered with,
+// or an empty string if it wasn't registered.
+func Name(d Driver) string {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	for name, factory := range drivers {
+		if reflect.TypeOf(factory()) == reflect.TypeOf(d) {
+			return name
+		}
+	}
+	return ""
+}
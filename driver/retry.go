@@ -0,0 +1,42 @@
+package driver
+
+import "github.com/gemnasium/migrate/file"
+
+// RetryClassifier is implemented by drivers able to tell transient
+// errors, such as deadlocks or serialization failures, from the others.
+// A migration failing with a transient error may succeed if run again.
+type RetryClassifier interface {
+
+	// Retryable reports whether err, sent by Migrate, is transient.
+	Retryable(err error) bool
+}
+
+// Transactional is implemented by drivers running migration files in
+// transactions, so that a failed migration leaves no trace and can
+// safely be run again.
+type Transactional interface {
+
+	// InTransaction reports whether f runs in a single transaction,
+	// rolled back entirely if it fails.
+	InTransaction(f file.File) bool
+}
+
+// WithMessage returns an error printed as message, which unwraps to err.
+// Drivers use it to describe backend errors with more context, while
+// keeping them available to Retryable.
+func WithMessage(err error, message string) error {
+	return &messageError{err: err, message: message}
+}
+
+type messageError struct {
+	err     error
+	message string
+}
+
+func (e *messageError) Error() string {
+	return e.message
+}
+
+func (e *messageError) Unwrap() error {
+	return e.err
+}
@@ -2,24 +2,42 @@
 package sqlite3
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/event"
 	"github.com/gemnasium/migrate/file"
 	"github.com/gemnasium/migrate/migrate/direction"
+	"github.com/gemnasium/migrate/sqlsplit"
 	"github.com/mattn/go-sqlite3"
 )
 
 type Driver struct {
 	db *sql.DB
+
+	// table is the version table, see driver.ParseTable
+	table driver.Table
 }
 
-const tableName = "schema_migration"
+// defaultTableName is singular for historical reasons,
+// other drivers use schema_migrations.
+const defaultTableName = "schema_migration"
 
+// The table name and the schema, i.e. the name of an attached database,
+// can be set with the x-migrations-table and x-migrations-schema params.
 func (driver *Driver) Initialize(url string) error {
+	url, table, err := parseTable(url)
+	if err != nil {
+		return err
+	}
+	driver.table = table
+
 	filename := strings.SplitN(url, "sqlite3://", 2)
 	if len(filename) != 2 {
 		return errors.New("invalid sqlite3:// scheme")
@@ -48,9 +66,55 @@ func (driver *Driver) Close() error {
 }
 
 func (driver *Driver) ensureVersionTableExists() error {
-	if _, err := driver.db.Exec("CREATE TABLE IF NOT EXISTS " + tableName + " (version INTEGER PRIMARY KEY AUTOINCREMENT);"); err != nil {
+	if _, err := driver.db.Exec("CREATE TABLE IF NOT EXISTS " + driver.versionTable() + " (version INTEGER PRIMARY KEY AUTOINCREMENT);"); err != nil {
+		return err
+	}
+	return driver.addMissingColumns()
+}
+
+// versionColumns are the columns added to the version table over time.
+var versionColumns = []struct{ name, definition string }{
+	{"checksum", "TEXT"},
+	{"dirty", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"name", "TEXT"},
+	{"applied_at", "DATETIME"},
+	{"duration_ms", "INTEGER"},
+	{"host", "TEXT"},
+}
+
+// addMissingColumns upgrades version tables created by older releases.
+func (driver *Driver) addMissingColumns() error {
+	pragma := "PRAGMA table_info(" + quoteIdentifier(driver.table.Name) + ")"
+	if driver.table.Schema != "" {
+		pragma = "PRAGMA " + quoteIdentifier(driver.table.Schema) + ".table_info(" + quoteIdentifier(driver.table.Name) + ")"
+	}
+	rows, err := driver.db.Query(pragma)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	existing := map[string]bool{}
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, dataType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &dataType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
 		return err
 	}
+
+	for _, column := range versionColumns {
+		if existing[column.name] {
+			continue
+		}
+		if _, err := driver.db.Exec("ALTER TABLE " + driver.versionTable() + " ADD COLUMN " + column.name + " " + column.definition); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -59,66 +123,303 @@ func (driver *Driver) FilenameExtension() string {
 }
 
 func (driver *Driver) Migrate(f file.File, pipe chan interface{}) {
+	driver.MigrateContext(context.Background(), f, pipe)
+}
+
+// MigrateContext is like Migrate, but cancels the running statement
+// and rolls back the transaction once ctx is done.
+func (driver *Driver) MigrateContext(ctx context.Context, f file.File, pipe chan interface{}) {
 	defer close(pipe)
 	pipe <- f
 
-	tx, err := driver.db.Begin()
+	directives, err := f.Directives()
 	if err != nil {
 		pipe <- err
 		return
 	}
+	if directives.NoTransaction {
+		driver.migrate(ctx, nil, f, pipe)
+		return
+	}
 
-	if f.Direction == direction.Up {
-		if _, err := tx.Exec("INSERT INTO "+tableName+" (version) VALUES (?)", f.Version); err != nil {
-			pipe <- err
-			if err := tx.Rollback(); err != nil {
-				pipe <- err
-			}
-			return
+	tx, err := driver.db.BeginTx(ctx, nil)
+	if err != nil {
+		pipe <- err
+		return
+	}
+	if ok := driver.migrate(ctx, tx, f, pipe); !ok {
+		rollback(tx, pipe)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		pipe <- err
+		return
+	}
+}
+
+// BeginTx starts a transaction for MigrateTx.
+func (driver *Driver) BeginTx(ctx context.Context) (driver.Tx, error) {
+	tx, err := driver.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// MigrateTx runs f in tx, or outside of a transaction if tx is nil.
+func (driver *Driver) MigrateTx(ctx context.Context, tx driver.Tx, f file.File, pipe chan interface{}) {
+	defer close(pipe)
+	pipe <- f
+	driver.migrate(ctx, tx, f, pipe)
+}
+
+// migrate runs f and records its version in tx. If tx is nil, statements
+// already executed can't be rolled back: the version is flagged as dirty
+// until they all succeed.
+func (driver *Driver) migrate(ctx context.Context, tx driver.Tx, f file.File, pipe chan interface{}) (ok bool) {
+	start := time.Now()
+	checksum, err := f.Checksum()
+	if err != nil {
+		pipe <- err
+		return false
+	}
+
+	var exec file.Tx = tx
+	if tx == nil {
+		exec = driver.db
+		// the version of a failed run may still be there
+		if f.Direction == direction.Up {
+			_, err = exec.ExecContext(ctx, "INSERT INTO "+driver.versionTable()+" (version, checksum, name, host, applied_at, dirty) VALUES (?, ?, ?, ?, ?, 1)"+
+				" ON CONFLICT (version) DO UPDATE SET checksum = excluded.checksum, name = excluded.name, host = excluded.host, applied_at = excluded.applied_at, dirty = 1", f.Version, checksum, f.Name, host(), start)
+		} else if f.Direction == direction.Down {
+			_, err = exec.ExecContext(ctx, "UPDATE "+driver.versionTable()+" SET dirty = 1 WHERE version=?", f.Version)
 		}
+	} else if f.Direction == direction.Up {
+		_, err = exec.ExecContext(ctx, "INSERT INTO "+driver.versionTable()+" (version, checksum, name, host, applied_at) VALUES (?, ?, ?, ?, ?)", f.Version, checksum, f.Name, host(), start)
 	} else if f.Direction == direction.Down {
-		if _, err := tx.Exec("DELETE FROM "+tableName+" WHERE version=?", f.Version); err != nil {
-			pipe <- err
-			if err := tx.Rollback(); err != nil {
-				pipe <- err
-			}
-			return
-		}
+		_, err = exec.ExecContext(ctx, "DELETE FROM "+driver.versionTable()+" WHERE version=?", f.Version)
+	}
+	if err != nil {
+		pipe <- err
+		return false
 	}
 
-	if err := f.ReadContent(); err != nil {
+	if err := execStatements(ctx, exec, f, pipe); err != nil {
 		pipe <- err
-		return
+		return false
 	}
 
-	queries := splitStatements(string(f.Content))
-	for _, query := range queries {
-		if _, err := tx.Exec(query); err != nil {
-			sqliteErr, isErr := err.(sqlite3.Error)
-			if isErr {
-				// The sqlite3 library only provides error codes, not position information. Output what we do know.
-				pipe <- fmt.Errorf("SQLite Error (%s); Extended (%s)\nError: %s",
-					sqliteErr.Code.Error(), sqliteErr.ExtendedCode.Error(), sqliteErr.Error())
-			} else {
-				pipe <- fmt.Errorf("An error occurred when running query [%q]: %v", query, err)
-			}
-			if err := tx.Rollback(); err != nil {
-				pipe <- err
-			}
-			return
+	if f.Direction == direction.Up {
+		_, err = exec.ExecContext(ctx, "UPDATE "+driver.versionTable()+" SET dirty = 0, duration_ms=? WHERE version=?", milliseconds(time.Since(start)), f.Version)
+	} else if tx == nil {
+		_, err = exec.ExecContext(ctx, "DELETE FROM "+driver.versionTable()+" WHERE version=?", f.Version)
+	}
+	if err != nil {
+		pipe <- err
+		return false
+	}
+	return true
+}
+
+// execStatements runs the Go function or the statements of f with tx,
+// reporting each executed statement.
+func execStatements(ctx context.Context, tx file.Tx, f file.File, pipe chan interface{}) error {
+	if f.Func != nil {
+		if err := f.Func(ctx, tx); err != nil {
+			return driver.NewMigrationError(f, 0, -1, "", err)
 		}
+		return nil
 	}
 
-	if err := tx.Commit(); err != nil {
+	statements, err := sqlsplit.Split(f.Content, sqlsplit.SQLite)
+	if err != nil {
+		return err
+	}
+	for i, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement.Text); err != nil {
+			return describeError(f, i, statement, err)
+		}
+		pipe <- event.Event{Kind: event.StatementExecuted, File: &f, Statement: statement.Text, Offset: statement.Offset}
+	}
+	return nil
+}
+
+// describeError returns err, raised by the statement at index i of f,
+// as a *driver.MigrationError located at the start of the statement.
+func describeError(f file.File, i int, statement sqlsplit.Statement, err error) error {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return driver.NewMigrationError(f, i, statement.Offset, "",
+			driver.WithMessage(err, fmt.Sprintf("An error occurred when running query [%q]: %v", statement.Text, err)))
+	}
+	// The sqlite3 library only provides error codes, not position information. Output what we do know.
+	return driver.NewMigrationError(f, i, statement.Offset, strconv.Itoa(int(sqliteErr.ExtendedCode)),
+		driver.WithMessage(sqliteErr, fmt.Sprintf("SQLite Error (%s); Extended (%s)\nError: %s",
+			sqliteErr.Code.Error(), sqliteErr.ExtendedCode.Error(), sqliteErr.Error())))
+}
+
+// Retryable reports whether err is caused by a database busy or locked
+// by another connection.
+func (driver *Driver) Retryable(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// InTransaction reports whether f runs in a transaction, which is
+// the case unless it has the no-transaction directive.
+func (driver *Driver) InTransaction(f file.File) bool {
+	directives, err := f.Directives()
+	return err == nil && !directives.NoTransaction
+}
+
+// rollback rolls back tx. A transaction already rolled back
+// because its context was cancelled is not reported as an error.
+func rollback(tx *sql.Tx, pipe chan interface{}) {
+	if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
 		pipe <- err
-		return
 	}
 }
 
+// Lock inserts the single row of the lock table, waiting for it to be
+// deleted if another run already holds the lock. The row is left behind
+// if the process running the migrations dies: delete it by hand then.
+func (driver *Driver) Lock(ctx context.Context) error {
+	if _, err := driver.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+driver.lockTable()+" (id INTEGER PRIMARY KEY);"); err != nil {
+		return err
+	}
+	return insertLockRow(ctx, driver.db, driver.lockTable())
+}
+
+// Unlock deletes the row inserted by Lock.
+func (driver *Driver) Unlock() error {
+	_, err := driver.db.Exec("DELETE FROM " + driver.lockTable() + " WHERE id = 1")
+	return err
+}
+
+// ForceUnlock deletes the row inserted by Lock, whoever inserted it.
+func (driver *Driver) ForceUnlock() error {
+	if _, err := driver.db.Exec("CREATE TABLE IF NOT EXISTS " + driver.lockTable() + " (id INTEGER PRIMARY KEY);"); err != nil {
+		return err
+	}
+	return driver.Unlock()
+}
+
+// Records returns the applied migrations, newest first.
+func (driver *Driver) Records() ([]driver.Record, error) {
+	return readRecords(driver.db, driver.versionTable())
+}
+
+// Dirty returns the versions flagged as dirty. Only migrations run
+// outside of a transaction can leave their version dirty.
+func (driver *Driver) Dirty() (file.Versions, error) {
+	versions := file.Versions{}
+
+	rows, err := driver.db.Query("SELECT version FROM " + driver.versionTable() + " WHERE dirty = 1 ORDER BY version DESC")
+	if err != nil {
+		return versions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version file.Version
+		if err := rows.Scan(&version); err != nil {
+			return versions, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// ClearDirty removes the dirty flag of version, removing version
+// altogether unless applied is true.
+func (driver *Driver) ClearDirty(version file.Version, applied bool) error {
+	var err error
+	if applied {
+		_, err = driver.db.Exec("UPDATE "+driver.versionTable()+" SET dirty = 0 WHERE version=?", version)
+	} else {
+		_, err = driver.db.Exec("DELETE FROM "+driver.versionTable()+" WHERE version=?", version)
+	}
+	return err
+}
+
+// readRecords reads the version table into records.
+func readRecords(db *sql.DB, table string) ([]driver.Record, error) {
+	records := []driver.Record{}
+
+	rows, err := db.Query("SELECT version, name, applied_at, duration_ms, host FROM " + table + " ORDER BY version DESC")
+	if err != nil {
+		return records, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version file.Version
+		var name, host sql.NullString
+		var appliedAt *time.Time
+		var durationMs sql.NullInt64
+		if err := rows.Scan(&version, &name, &appliedAt, &durationMs, &host); err != nil {
+			return records, err
+		}
+		record := driver.Record{
+			Version:  version,
+			Name:     name.String,
+			Duration: time.Duration(durationMs.Int64) * time.Millisecond,
+			Host:     host.String,
+		}
+		if appliedAt != nil {
+			record.AppliedAt = *appliedAt
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// parseTable reads the version table from url.
+func parseTable(url string) (string, driver.Table, error) {
+	return driver.ParseTable(url, defaultTableName)
+}
+
+// versionTable returns the version table name to use in queries.
+func (driver *Driver) versionTable() string {
+	return driver.table.QualifiedName(quoteIdentifier)
+}
+
+// lockTable returns the lock table name to use in queries.
+func (driver *Driver) lockTable() string {
+	return driver.table.Suffixed("_lock").QualifiedName(quoteIdentifier)
+}
+
+// quoteIdentifier quotes table and schema names.
+func quoteIdentifier(name string) string {
+	return driver.QuoteIdentifier(name)
+}
+
+// host returns the value recorded in the host column.
+func host() string {
+	return driver.Host()
+}
+
+// milliseconds returns d rounded down to milliseconds.
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// insertLockRow polls until the lock row could be inserted.
+func insertLockRow(ctx context.Context, db *sql.DB, table string) error {
+	return driver.PollLock(ctx, func() (bool, error) {
+		_, err := db.ExecContext(ctx, "INSERT INTO "+table+" (id) VALUES (1)")
+		if sqliteErr, isErr := err.(sqlite3.Error); isErr && sqliteErr.Code == sqlite3.ErrConstraint {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
 // Version returns the current migration version.
 func (driver *Driver) Version() (file.Version, error) {
 	var version file.Version
-	err := driver.db.QueryRow("SELECT version FROM " + tableName + " ORDER BY version DESC LIMIT 1").Scan(&version)
+	err := driver.db.QueryRow("SELECT version FROM " + driver.versionTable() + " ORDER BY version DESC LIMIT 1").Scan(&version)
 	switch {
 	case err == sql.ErrNoRows:
 		return 0, nil
@@ -133,7 +434,7 @@ func (driver *Driver) Version() (file.Version, error) {
 func (driver *Driver) Versions() (file.Versions, error) {
 	versions := file.Versions{}
 
-	rows, err := driver.db.Query("SELECT version FROM " + tableName + " ORDER BY version DESC")
+	rows, err := driver.db.Query("SELECT version FROM " + driver.versionTable() + " ORDER BY version DESC")
 	if err != nil {
 		return versions, err
 	}
@@ -150,20 +451,29 @@ func (driver *Driver) Versions() (file.Versions, error) {
 	return versions, err
 }
 
-func init() {
-	driver.RegisterDriver("sqlite3", &Driver{})
-}
-
-// This naive implementation doesn't account for quoted ";" inside statements.
-// It should work for most migrations but can be improved in the future.
-func splitStatements(in string) []string {
-	result := make([]string, 0)
+// Checksums returns the checksums of the applied migrations.
+// Migrations applied before checksums were recorded are left out.
+func (driver *Driver) Checksums() (map[file.Version]string, error) {
+	checksums := make(map[file.Version]string)
 
-	qs := strings.Split(in, ";")
-	for _, q := range qs {
-		if q = strings.TrimSpace(q); q != "" {
-			result = append(result, q+";")
+	rows, err := driver.db.Query("SELECT version, checksum FROM " + driver.versionTable())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version file.Version
+		var checksum sql.NullString
+		if err := rows.Scan(&version, &checksum); err != nil {
+			return nil, err
+		}
+		if checksum.Valid {
+			checksums[version] = checksum.String
 		}
 	}
-	return result
+	return checksums, rows.Err()
+}
+
+func init() {
+	driver.RegisterFactory("sqlite3", func() driver.Driver { return &Driver{} })
 }
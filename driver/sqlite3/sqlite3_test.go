@@ -1,14 +1,19 @@
 package sqlite3
 
 import (
+	"database/sql"
+	"errors"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/gemnasium/migrate/driver"
 	"github.com/gemnasium/migrate/file"
 	"github.com/gemnasium/migrate/migrate/direction"
 	pipep "github.com/gemnasium/migrate/pipe"
+	"github.com/gemnasium/migrate/sqlsplit"
 )
 
 // TestMigrate runs some additional tests on Migrate()
@@ -137,25 +142,225 @@ func TestMigrate(t *testing.T) {
 	}
 }
 
+func TestDirty(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "migrate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	d := &Driver{}
+	if err := d.Initialize("sqlite3://" + f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if _, err := d.db.Exec("INSERT INTO " + d.versionTable() + " (version, dirty) VALUES (1, 0), (2, 1), (3, 1)"); err != nil {
+		t.Fatal(err)
+	}
+	dirty, err := d.Dirty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (file.Versions{3, 2}); !reflect.DeepEqual(dirty, expected) {
+		t.Errorf("Expected dirty versions to be: %v, got: %v", expected, dirty)
+	}
+
+	if err := d.ClearDirty(3, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ClearDirty(2, false); err != nil {
+		t.Fatal(err)
+	}
+	dirty, err = d.Dirty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirty) != 0 {
+		t.Errorf("Expected no dirty versions, got: %v", dirty)
+	}
+	versions, err := d.Versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (file.Versions{3, 1}); !reflect.DeepEqual(versions, expected) {
+		t.Errorf("Expected versions to be: %v, got: %v", expected, versions)
+	}
+}
+
+func TestNoTransaction(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "migrate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	d := &Driver{}
+	if err := d.Initialize("sqlite3://" + f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	pipe := pipep.New()
+	go d.Migrate(file.File{
+		FileName:  "1_partial.up.sql",
+		Version:   1,
+		Name:      "partial",
+		Direction: direction.Up,
+		Content:   []byte("-- migrate:no-transaction\nCREATE TABLE partial (id INTEGER);\nCREATE TABLE error (THIS; WILL CAUSE; AN ERROR;)"),
+	}, pipe)
+	if errs := pipep.ReadErrors(pipe); len(errs) == 0 {
+		t.Fatal("Expected test case to fail")
+	}
+	if _, err := d.db.Exec("SELECT id FROM partial"); err != nil {
+		t.Errorf("Expected the first statement not to be rolled back: %v", err)
+	}
+	dirty, err := d.Dirty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (file.Versions{1}); !reflect.DeepEqual(dirty, expected) {
+		t.Errorf("Expected dirty versions to be: %v, got: %v", expected, dirty)
+	}
+
+	pipe = pipep.New()
+	go d.Migrate(file.File{
+		FileName:  "2_vacuum.up.sql",
+		Version:   2,
+		Name:      "vacuum",
+		Direction: direction.Up,
+		Content:   []byte("-- migrate:no-transaction\nVACUUM;"),
+	}, pipe)
+	if errs := pipep.ReadErrors(pipe); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	dirty, err = d.Dirty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (file.Versions{1}); !reflect.DeepEqual(dirty, expected) {
+		t.Errorf("Expected dirty versions to be: %v, got: %v", expected, dirty)
+	}
+}
+
+func TestMigrationError(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "migrate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	d := &Driver{}
+	if err := d.Initialize("sqlite3://" + f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	pipe := pipep.New()
+	go d.Migrate(file.File{
+		FileName:  "1_error.up.sql",
+		Version:   1,
+		Name:      "error",
+		Direction: direction.Up,
+		Content:   []byte("CREATE TABLE a (id INTEGER);\n\n  INSERT INTO missing VALUES (1);"),
+	}, pipe)
+	errs := pipep.ReadErrors(pipe)
+	if len(errs) != 1 {
+		t.Fatalf("Expected one error, got %v", errs)
+	}
+	var migrationErr *driver.MigrationError
+	if !errors.As(errs[0], &migrationErr) {
+		t.Fatalf("Expected a *driver.MigrationError, got %#v", errs[0])
+	}
+	if e := migrationErr; e.FileName != "1_error.up.sql" || e.Version != 1 || e.Direction != direction.Up ||
+		e.Statement != 1 || e.Line != 3 || e.Column != 3 || e.Code != "1" {
+		t.Errorf("Unexpected error %+v", e)
+	}
+	if !strings.HasPrefix(migrationErr.Error(), "1_error.up.sql line 3 column 3: SQLite Error") {
+		t.Errorf("Unexpected error message %q", migrationErr.Error())
+	}
+}
+
+func TestRecords(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "migrate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	// version table created by an older release
+	db, err := sql.Open("sqlite3", f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE TABLE " + defaultTableName + " (version INTEGER PRIMARY KEY AUTOINCREMENT); INSERT INTO " + defaultTableName + " (version) VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	d := &Driver{}
+	if err := d.Initialize("sqlite3://" + f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	pipe := pipep.New()
+	go d.Migrate(file.File{
+		FileName:  "2_foobar.up.sql",
+		Version:   2,
+		Name:      "foobar",
+		Direction: direction.Up,
+		Content:   []byte("CREATE TABLE foobar (id INTEGER);"),
+	}, pipe)
+	if errs := pipep.ReadErrors(pipe); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	records, err := d.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got: %v", records)
+	}
+	if r := records[0]; r.Version != 2 || r.Name != "foobar" || r.Host == "" || r.AppliedAt.IsZero() {
+		t.Errorf("Expected a complete record for version 2, got: %+v", r)
+	}
+	if r := records[1]; r.Version != 1 || r.Name != "" || !r.AppliedAt.IsZero() {
+		t.Errorf("Expected an empty record for version 1, got: %+v", r)
+	}
+}
+
 func TestSplitStatements(t *testing.T) {
 	testCases := []struct {
 		name string
 		q    string
 		want []string
 	}{
-		{"empty noop", "", []string{}},
-		{"single query", "CREATE TABLE a id INT;", []string{"CREATE TABLE a id INT;"}},
+		{"empty noop", "", nil},
+		{"single query", "CREATE TABLE a id INT;", []string{"CREATE TABLE a id INT"}},
 		{"multiple queries", "CREATE TABLE a id INT; CREATE TABLE b id INT; ",
-			[]string{"CREATE TABLE a id INT;", "CREATE TABLE b id INT;"},
+			[]string{"CREATE TABLE a id INT", "CREATE TABLE b id INT"},
 		},
 		{"with line breaks", "CREATE TABLE a id INT;\n\n\t CREATE TABLE b id INT; ",
-			[]string{"CREATE TABLE a id INT;", "CREATE TABLE b id INT;"},
+			[]string{"CREATE TABLE a id INT", "CREATE TABLE b id INT"},
+		},
+		{"quoted delimiter", "INSERT INTO a VALUES (';');", []string{"INSERT INTO a VALUES (';')"}},
+		{"trigger", "CREATE TRIGGER t AFTER INSERT ON a BEGIN DELETE FROM b; END;",
+			[]string{"CREATE TRIGGER t AFTER INSERT ON a BEGIN DELETE FROM b; END"},
 		},
 	}
 	for _, tc := range testCases {
-		got := splitStatements(tc.q)
+		statements, err := sqlsplit.Split([]byte(tc.q), sqlsplit.SQLite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range statements {
+			got = append(got, s.Text)
+		}
 		if !reflect.DeepEqual(got, tc.want) {
-			t.Errorf("(%s) splitStatements(%q) = %q, want: %q", tc.name, tc.q, got, tc.want)
+			t.Errorf("(%s) sqlsplit.Split(%q) = %q, want: %q", tc.name, tc.q, got, tc.want)
 		}
 	}
 }
@@ -0,0 +1,89 @@
+package driver
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// URL query parameters locating the version table. All drivers honour
+// them and remove them from the url before opening the database.
+const (
+	TableParam  = "x-migrations-table"
+	SchemaParam = "x-migrations-schema"
+)
+
+// Table locates the version table of a driver.
+type Table struct {
+	// Schema is the schema, database or keyspace holding the table,
+	// empty for the one the driver is connected to.
+	Schema string
+
+	Name string
+}
+
+// ParseTable returns rawurl without the x-migrations-* query parameters
+// and the version table they locate, named defaultName unless set.
+// The other parameters are left untouched: some drivers take DSNs which
+// can't be parsed as urls, and not all of them unescape their values.
+func ParseTable(rawurl, defaultName string) (string, Table, error) {
+	table := Table{Name: defaultName}
+	i := strings.IndexByte(rawurl, '?')
+	if i < 0 {
+		return rawurl, table, nil
+	}
+
+	kept := make([]string, 0)
+	for _, param := range strings.Split(rawurl[i+1:], "&") {
+		kv := strings.SplitN(param, "=", 2)
+		key, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			return "", table, err
+		}
+		if key != TableParam && key != SchemaParam {
+			kept = append(kept, param)
+			continue
+		}
+
+		value := ""
+		if len(kv) == 2 {
+			if value, err = url.QueryUnescape(kv[1]); err != nil {
+				return "", table, err
+			}
+		}
+		if value == "" {
+			return "", table, fmt.Errorf("Empty value for url parameter %s", key)
+		}
+		if key == TableParam {
+			table.Name = value
+		} else {
+			table.Schema = value
+		}
+	}
+
+	if len(kept) == 0 {
+		return rawurl[:i], table, nil
+	}
+	return rawurl[:i+1] + strings.Join(kept, "&"), table, nil
+}
+
+// QualifiedName returns the name of t to use in queries,
+// qualified with its schema if any and quoted with quote.
+func (t Table) QualifiedName(quote func(string) string) string {
+	if t.Schema == "" {
+		return quote(t.Name)
+	}
+	return quote(t.Schema) + "." + quote(t.Name)
+}
+
+// Suffixed returns the table in the same schema as t, named after t
+// with suffix appended.
+func (t Table) Suffixed(suffix string) Table {
+	return Table{Schema: t.Schema, Name: t.Name + suffix}
+}
+
+// QuoteIdentifier quotes name with double quotes, as expected by
+// standard SQL.
+func QuoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
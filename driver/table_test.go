@@ -0,0 +1,47 @@
+package driver
+
+import "testing"
+
+func TestParseTable(t *testing.T) {
+	var tests = []struct {
+		url         string
+		expectURL   string
+		expectTable Table
+		expectErr   bool
+	}{
+		{"postgres://host/db", "postgres://host/db", Table{Name: "default"}, false},
+		{"postgres://host/db?sslmode=disable", "postgres://host/db?sslmode=disable", Table{Name: "default"}, false},
+		{"postgres://host/db?x-migrations-table=app1", "postgres://host/db", Table{Name: "app1"}, false},
+		{"postgres://host/db?sslmode=disable&x-migrations-table=app1&x-migrations-schema=history", "postgres://host/db?sslmode=disable", Table{Schema: "history", Name: "app1"}, false},
+		{"mysql://root@tcp(host:3306)/db?x-migrations-table=app%201&loc=Europe/Paris", "mysql://root@tcp(host:3306)/db?loc=Europe/Paris", Table{Name: "app 1"}, false},
+		{"sqlite3:///tmp/db?x-migrations-table=", "", Table{}, true},
+	}
+
+	for _, test := range tests {
+		url, table, err := ParseTable(test.url, "default")
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("ParseTable(%q): expected error, got none", test.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseTable(%q): unexpected error: %v", test.url, err)
+			continue
+		}
+		if url != test.expectURL || table != test.expectTable {
+			t.Errorf("ParseTable(%q): expected %q and %+v, got %q and %+v", test.url, test.expectURL, test.expectTable, url, table)
+		}
+	}
+}
+
+func TestQualifiedName(t *testing.T) {
+	table := Table{Name: `my"table`}
+	if name := table.QualifiedName(QuoteIdentifier); name != `"my""table"` {
+		t.Errorf("Unexpected name %s", name)
+	}
+	table = Table{Schema: "history", Name: "app1"}.Suffixed("_lock")
+	if name := table.QualifiedName(QuoteIdentifier); name != `"history"."app1_lock"` {
+		t.Errorf("Unexpected name %s", name)
+	}
+}
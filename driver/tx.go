@@ -0,0 +1,30 @@
+package driver
+
+import (
+	"context"
+
+	"github.com/gemnasium/migrate/file"
+)
+
+// Tx is a transaction shared by the migration files of a run,
+// see TxMigrator. *sql.Tx satisfies it.
+type Tx interface {
+	file.Tx
+	Commit() error
+	Rollback() error
+}
+
+// TxMigrator is implemented by drivers letting the caller control the
+// transaction migration files run in, so that a run can apply all its
+// files in a single transaction, or none in a transaction.
+type TxMigrator interface {
+
+	// BeginTx starts a transaction for MigrateTx.
+	BeginTx(ctx context.Context) (Tx, error)
+
+	// MigrateTx is like Migrate, but runs f and records its version in
+	// tx, which it neither commits nor rolls back, even if f fails.
+	// If tx is nil, f runs outside of any transaction, as if it had
+	// the no-transaction directive.
+	MigrateTx(ctx context.Context, tx Tx, f file.File, pipe chan interface{})
+}
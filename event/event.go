@@ -0,0 +1,111 @@
+// Package event holds the typed events sent while migrations are running.
+package event
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gemnasium/migrate/file"
+)
+
+// Kind is the type of an event.
+type Kind int
+
+const (
+	MigrationStarted  Kind = iota + 1 // a migration file is about to run
+	StatementExecuted                 // a statement of a migration file succeeded
+	MigrationFinished                 // a migration file ran successfully
+	Warning                           // something worth telling, but not an error
+	Error                             // something went wrong
+	Interrupted                       // the run was stopped before it completed
+)
+
+var kindNames = map[Kind]string{
+	MigrationStarted:  "migration_started",
+	StatementExecuted: "statement_executed",
+	MigrationFinished: "migration_finished",
+	Warning:           "warning",
+	Error:             "error",
+	Interrupted:       "interrupted",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("kind(%d)", int(k))
+}
+
+// Event is something that happened during a migration run.
+// Only the fields relevant to its Kind are set.
+type Event struct {
+	Kind Kind
+
+	// the migration file the event is about, if any
+	File *file.File
+
+	// the executed statement, for StatementExecuted
+	Statement string
+
+	// the byte offset of Statement in the file content, for StatementExecuted
+	Offset int
+
+	// the time it took to run the migration file, for MigrationFinished
+	Duration time.Duration
+
+	// a human readable text, for Warning and Interrupted
+	Message string
+
+	// the error, for Error and Interrupted
+	Err error
+}
+
+// Sink receives events. Handle is called synchronously from the
+// goroutine running the migrations, in the order events happen.
+type Sink interface {
+	Handle(e Event)
+}
+
+// SinkFunc is an adapter to use an ordinary function as a Sink.
+type SinkFunc func(e Event)
+
+// Handle calls f(e).
+func (f SinkFunc) Handle(e Event) {
+	f(e)
+}
+
+// FromPipe converts an item sent over a driver pipe into an Event.
+// Drivers may send Events themselves, they are returned unchanged.
+func FromPipe(item interface{}) Event {
+	switch v := item.(type) {
+	case Event:
+		return v
+	case file.File:
+		return Event{Kind: MigrationStarted, File: &v}
+	case error:
+		return Event{Kind: Error, Err: v}
+	case string:
+		return Event{Kind: Warning, Message: v}
+	default:
+		return Event{Kind: Warning, Message: fmt.Sprint(v)}
+	}
+}
+
+// PipeSink returns a Sink writing events to pipe, using the values
+// the pipe has always carried: file.File when a migration starts,
+// error for errors and string for anything worth printing.
+// Events without such a counterpart are dropped.
+func PipeSink(pipe chan interface{}) Sink {
+	return SinkFunc(func(e Event) {
+		switch e.Kind {
+		case MigrationStarted:
+			if e.File != nil {
+				pipe <- *e.File
+			}
+		case Error:
+			pipe <- e.Err
+		case Warning, Interrupted:
+			pipe <- e.Message
+		}
+	})
+}
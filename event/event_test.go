@@ -0,0 +1,61 @@
+package event
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/gemnasium/migrate/file"
+	"github.com/gemnasium/migrate/migrate/direction"
+)
+
+func TestFromPipe(t *testing.T) {
+	f := file.File{FileName: "001_test.up.sql", Version: 1, Direction: direction.Up}
+	err := errors.New("boom")
+	e := Event{Kind: StatementExecuted, Statement: "SELECT 1"}
+
+	var tests = []struct {
+		item   interface{}
+		expect Event
+	}{
+		{f, Event{Kind: MigrationStarted, File: &f}},
+		{err, Event{Kind: Error, Err: err}},
+		{"hello", Event{Kind: Warning, Message: "hello"}},
+		{42, Event{Kind: Warning, Message: "42"}},
+		{e, e},
+	}
+
+	for _, test := range tests {
+		if got := FromPipe(test.item); !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("FromPipe(%v): expected %+v, got %+v", test.item, test.expect, got)
+		}
+	}
+}
+
+func TestPipeSink(t *testing.T) {
+	f := file.File{FileName: "001_test.up.sql", Version: 1, Direction: direction.Up}
+	err := errors.New("boom")
+	events := []Event{
+		{Kind: MigrationStarted, File: &f},
+		{Kind: StatementExecuted, File: &f, Statement: "SELECT 1"},
+		{Kind: Error, File: &f, Err: err},
+		{Kind: MigrationFinished, File: &f},
+		{Kind: Warning, Message: "careful"},
+	}
+
+	pipe := make(chan interface{}, len(events))
+	sink := PipeSink(pipe)
+	for _, e := range events {
+		sink.Handle(e)
+	}
+	close(pipe)
+
+	items := []interface{}{}
+	for item := range pipe {
+		items = append(items, item)
+	}
+	expect := []interface{}{f, err, "careful"}
+	if !reflect.DeepEqual(items, expect) {
+		t.Errorf("Expected pipe items %v, got %v", expect, items)
+	}
+}
@@ -0,0 +1,189 @@
+package file
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// archiveExtensions are the archive formats Archive can read.
+var archiveExtensions = []string{".tar", ".tar.gz", ".tgz", ".zip"}
+
+// IsArchive reports whether name is a .tar, .tar.gz, .tgz or .zip file.
+func IsArchive(name string) bool {
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// PathSource returns the Source of the migration files at path:
+// an *Archive if IsArchive(path), or else a Dir.
+func PathSource(path string) Source {
+	if IsArchive(path) {
+		return &Archive{Path: path}
+	}
+	return Dir(path)
+}
+
+// Archive is the Source of the migration files in a .tar, .tar.gz,
+// .tgz or .zip file. The archive is read into memory the first
+// time files are listed or read.
+type Archive struct {
+	// Path of the archive file.
+	Path string
+
+	// Prefix is the directory of the migration files inside
+	// the archive. Empty means the root of the archive.
+	Prefix string
+
+	// SHA256, if set, is the hex encoded SHA-256 checksum the archive
+	// file must match. Nothing is read from a mismatching archive.
+	SHA256 string
+
+	once  sync.Once
+	files map[string][]byte
+	err   error
+}
+
+// FileNames returns the names of the files in the prefix directory
+// of the archive, sorted.
+func (a *Archive) FileNames() ([]string, error) {
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(a.files))
+	for name := range a.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ReadFile returns the content of the named file of the prefix directory.
+func (a *Archive) ReadFile(name string) ([]byte, error) {
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	content, ok := a.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path.Join(a.Path, a.prefix(), name), Err: os.ErrNotExist}
+	}
+	return content, nil
+}
+
+func (a *Archive) load() error {
+	a.once.Do(func() {
+		a.files, a.err = a.read()
+	})
+	return a.err
+}
+
+func (a *Archive) read() (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	if a.SHA256 != "" {
+		sum := sha256.Sum256(data)
+		if checksum := hex.EncodeToString(sum[:]); !strings.EqualFold(checksum, a.SHA256) {
+			return nil, fmt.Errorf("archive %s has checksum %s, expected %s", a.Path, checksum, a.SHA256)
+		}
+	}
+
+	files := make(map[string][]byte)
+	add := func(name string, r io.Reader) error {
+		name = path.Clean(strings.TrimPrefix(name, "/"))
+		if path.Dir(name) != a.prefix() {
+			return nil
+		}
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		files[path.Base(name)] = content
+		return nil
+	}
+
+	lower := strings.ToLower(a.Path)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		err = readZip(data, add)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(bytes.NewReader(data))
+		if err == nil {
+			err = readTar(gz, add)
+		}
+	case strings.HasSuffix(lower, ".tar"):
+		err = readTar(bytes.NewReader(data), add)
+	default:
+		err = fmt.Errorf("%s is not a .tar, .tar.gz, .tgz or .zip archive", a.Path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading archive %s: %v", a.Path, err)
+	}
+	if len(files) == 0 && a.prefix() != "." {
+		return nil, fmt.Errorf("no files in %s of archive %s", a.Prefix, a.Path)
+	}
+	return files, nil
+}
+
+// prefix returns the cleaned prefix, "." for the root of the archive.
+func (a *Archive) prefix() string {
+	return path.Clean(strings.Trim(a.Prefix, "/"))
+}
+
+func readTar(r io.Reader, add func(name string, r io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if err := add(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func readZip(data []byte, add func(name string, r io.Reader) error) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = add(zf.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package file
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+var archiveFiles = map[string]string{
+	"release/db/001_init.up.sql":   "CREATE TABLE t (id int);",
+	"release/db/001_init.down.sql": "DROP TABLE t;",
+	"release/db/old/000_x.up.sql":  "SELECT 1;",
+	"release/README.md":            "release notes",
+}
+
+func TestArchive(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("/tmp", "TestArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	if _, ok := PathSource(tmpdir).(Dir); !ok {
+		t.Errorf("Expected the source of %s to be a directory", tmpdir)
+	}
+
+	archives := map[string][]byte{
+		"release.tar":    tarArchive(t, false),
+		"release.tar.gz": tarArchive(t, true),
+		"release.zip":    zipArchive(t),
+	}
+	for name, data := range archives {
+		archivePath := path.Join(tmpdir, name)
+		if err := ioutil.WriteFile(archivePath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !IsArchive(archivePath) {
+			t.Errorf("Expected %s to be an archive", name)
+		}
+		if _, ok := PathSource(archivePath).(*Archive); !ok {
+			t.Errorf("Expected the source of %s to be an archive", name)
+		}
+		sum := sha256.Sum256(data)
+
+		a := &Archive{Path: archivePath, Prefix: "release/db/", SHA256: hex.EncodeToString(sum[:])}
+		files, err := ReadSourceMigrationFiles(a, FilenameRegex("sql"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(files) != 1 || files[0].Version != 1 {
+			t.Fatalf("%s: expected version 1 only, got %v", name, files)
+		}
+		if err := files[0].UpFile.ReadContent(); err != nil {
+			t.Fatal(err)
+		}
+		if string(files[0].UpFile.Content) != archiveFiles["release/db/001_init.up.sql"] {
+			t.Errorf("%s: unexpected content %q", name, files[0].UpFile.Content)
+		}
+
+		root, err := (&Archive{Path: archivePath}).FileNames()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(root) != 0 {
+			t.Errorf("%s: expected no files at the root, got %v", name, root)
+		}
+		readme, err := (&Archive{Path: archivePath, Prefix: "release"}).FileNames()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(readme, []string{"README.md"}) {
+			t.Errorf("%s: expected README.md in release, got %v", name, readme)
+		}
+
+		if _, err := (&Archive{Path: archivePath, Prefix: "missing"}).FileNames(); err == nil {
+			t.Errorf("%s: expected an error for a missing prefix", name)
+		}
+		if _, err := (&Archive{Path: archivePath, SHA256: "abc"}).FileNames(); err == nil {
+			t.Errorf("%s: expected a checksum mismatch", name)
+		}
+	}
+}
+
+func tarArchive(t *testing.T, compress bool) []byte {
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	}
+	for _, dir := range []string{"release/", "release/db/", "release/db/old/"} {
+		if err := tw.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range archiveFiles {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if compress {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range archiveFiles {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
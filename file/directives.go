@@ -0,0 +1,124 @@
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// directivePrefix starts the directives of a header comment.
+const directivePrefix = "migrate:"
+
+// Directives are the options of a migration file, set by header comments
+// such as "-- migrate:no-transaction". A comment can hold several
+// directives: "-- migrate:timeout=5m retries=3".
+type Directives struct {
+	// NoTransaction runs the file outside of a transaction, on drivers
+	// using them. Set by migrate:no-transaction, or by the older
+	// "-- disable_ddl_transaction" first line.
+	NoTransaction bool
+
+	// Timeout limits the time the file can run, zero means no limit.
+	// Set by migrate:timeout=<duration>, such as 30s or 5m.
+	Timeout time.Duration
+
+	// Retries is the number of times the file is run again after
+	// a failure. Set by migrate:retries=<n>.
+	Retries int
+}
+
+// ParseDirectives reads the directives of the header of content: the
+// comments and blank lines before the first statement. Unknown or
+// invalid directives are an error.
+func ParseDirectives(content []byte) (Directives, error) {
+	var d Directives
+	seen := make(map[string]bool)
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		comment, ok := commentText(string(line))
+		if !ok {
+			break
+		}
+		if i == 0 && hasWord(comment, "disable_ddl_transaction") {
+			d.NoTransaction = true
+		}
+		if !strings.HasPrefix(comment, directivePrefix) {
+			continue
+		}
+		for _, directive := range strings.Fields(strings.TrimPrefix(comment, directivePrefix)) {
+			name, value := directive, ""
+			if eq := strings.Index(directive, "="); eq >= 0 {
+				name, value = directive[:eq], directive[eq+1:]
+			}
+			if seen[name] {
+				return d, fmt.Errorf("line %d: duplicate directive %s", i+1, name)
+			}
+			seen[name] = true
+			if err := d.set(name, value); err != nil {
+				return d, fmt.Errorf("line %d: %v", i+1, err)
+			}
+		}
+	}
+	return d, nil
+}
+
+// set sets the directive name to value.
+func (d *Directives) set(name, value string) error {
+	switch name {
+	case "no-transaction":
+		if value != "" {
+			return fmt.Errorf("directive %s takes no value", name)
+		}
+		d.NoTransaction = true
+	case "timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("directive %s needs a positive duration, such as 30s, got %q", name, value)
+		}
+		d.Timeout = timeout
+	case "retries":
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return fmt.Errorf("directive %s needs a number, got %q", name, value)
+		}
+		d.Retries = retries
+	default:
+		return fmt.Errorf("unknown directive %s", name)
+	}
+	return nil
+}
+
+// Directives returns the directives of the file, reading its content
+// first if needed. Go migrations have none.
+func (f *File) Directives() (Directives, error) {
+	if err := f.ReadContent(); err != nil {
+		return Directives{}, err
+	}
+	d, err := ParseDirectives(f.Content)
+	if err != nil {
+		return d, fmt.Errorf("%s: %v", f.FileName, err)
+	}
+	return d, nil
+}
+
+// commentText returns the text of a comment line, without its marker,
+// and false if line is not blank nor a comment.
+func commentText(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	for _, marker := range []string{"--", "#", "//"} {
+		if strings.HasPrefix(line, marker) {
+			return strings.TrimSpace(strings.TrimPrefix(line, marker)), true
+		}
+	}
+	return "", line == ""
+}
+
+func hasWord(s, word string) bool {
+	for _, w := range strings.Fields(s) {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package file
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDirectives(t *testing.T) {
+	var tests = []struct {
+		content   string
+		expected  Directives
+		expectErr bool
+	}{
+		{"CREATE TABLE t (id int);", Directives{}, false},
+		{"-- migrate:no-transaction\nCREATE INDEX CONCURRENTLY i ON t (id);", Directives{NoTransaction: true}, false},
+		{"-- disable_ddl_transaction\nALTER TYPE colors ADD VALUE 'blue';", Directives{NoTransaction: true}, false},
+		{"-- add users\n\n-- migrate:timeout=5m retries=3\n# migrate:no-transaction\nSELECT 1;", Directives{NoTransaction: true, Timeout: 5 * time.Minute, Retries: 3}, false},
+		{"SELECT 1;\n-- migrate:no-transaction", Directives{}, false},
+		{"-- migrate:no-transactions", Directives{}, true},
+		{"-- migrate:no-transaction=yes", Directives{}, true},
+		{"-- migrate:timeout=forever", Directives{}, true},
+		{"-- migrate:timeout=-1s", Directives{}, true},
+		{"-- migrate:retries=-1", Directives{}, true},
+		{"-- migrate:retries=1\n-- migrate:retries=2", Directives{}, true},
+	}
+	for _, test := range tests {
+		d, err := ParseDirectives([]byte(test.content))
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("ParseDirectives(%q): expected error, got none", test.content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseDirectives(%q): unexpected error: %v", test.content, err)
+			continue
+		}
+		if d != test.expected {
+			t.Errorf("ParseDirectives(%q): expected %+v, got %+v", test.content, test.expected, d)
+		}
+	}
+}
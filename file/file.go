@@ -3,6 +3,8 @@ package file
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"go/token"
@@ -16,10 +18,11 @@ import (
 	"github.com/gemnasium/migrate/migrate/direction"
 )
 
-var filenameRegex = `^([0-9]+)_(.*)\.(up|down)\.%s$`
+var filenameRegex = `^([0-9]+)_(.*?)(?:\.(up|down))?\.%s$`
 
 // FilenameRegex builds regular expression stmt with given
-// filename extension from driver.
+// filename extension from driver. It matches both the up and down
+// files of a migration and single files holding both, see splitSections.
 func FilenameRegex(filenameExtension string) *regexp.Regexp {
 	return regexp.MustCompile(fmt.Sprintf(filenameRegex, filenameExtension))
 }
@@ -60,6 +63,9 @@ type File struct {
 	// absolute path to file
 	Path string
 
+	// source the file is read from, if not Path
+	Source Source
+
 	// the name of the file
 	FileName string
 
@@ -74,6 +80,19 @@ type File struct {
 
 	// UP or DOWN migration
 	Direction direction.Direction
+
+	// Go function run instead of the content, see NewFuncMigration
+	Func Func
+
+	// content before Expand, used for the checksum
+	original []byte
+
+	// placeholders replaced by Expand, see Position
+	substitutions []substitution
+
+	// number of lines preceding the content in the file,
+	// for the sections of single file migrations
+	lineOffset int
 }
 
 // Files is a slice of Files.
@@ -95,9 +114,18 @@ type MigrationFile struct {
 type MigrationFiles []MigrationFile
 
 // ReadContent reads the file into the content if it's empty.
+// Go migrations have no content.
 func (f *File) ReadContent() error {
-	if len(f.Content) == 0 {
-		content, err := ioutil.ReadFile(path.Join(f.Path, f.FileName))
+	if len(f.Content) == 0 && f.Func == nil {
+		var content []byte
+		var err error
+		if s, ok := f.Source.(sectionSource); ok {
+			content, f.lineOffset, err = s.readSection(f.FileName)
+		} else if f.Source != nil {
+			content, err = f.Source.ReadFile(f.FileName)
+		} else {
+			content, err = ioutil.ReadFile(path.Join(f.Path, f.FileName))
+		}
 		if err != nil {
 			return err
 		}
@@ -106,6 +134,21 @@ func (f *File) ReadContent() error {
 	return nil
 }
 
+// Checksum returns the hex encoded SHA-256 hash of the file content,
+// reading the content first if needed. Variables replaced by Expand
+// don't change the checksum.
+func (f *File) Checksum() (string, error) {
+	if err := f.ReadContent(); err != nil {
+		return "", err
+	}
+	content := f.Content
+	if f.original != nil {
+		content = f.original
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
 // Pending returns the list of pending migration files.
 func (mf *MigrationFiles) Pending(versions Versions) (Files, error) {
 	sort.Sort(mf)
@@ -162,34 +205,117 @@ func (mf *MigrationFiles) Relative(relativeN int, versions Versions) (Files, err
 	return files[:relativeN], err
 }
 
+// Goto returns the migration files to run to land exactly on version:
+// down files of applied migrations above version, newest first, followed by
+// up files of pending migrations up to version, oldest first.
+// Version 0 rolls back every migration. Any other version must exist
+// in the migration files.
+func (mf *MigrationFiles) Goto(version Version, versions Versions) (Files, error) {
+	if version != 0 && !mf.contains(version) {
+		return nil, fmt.Errorf("Version %d not found in migration files", version)
+	}
+
+	files := make(Files, 0)
+	known := make(Versions, 0, len(*mf))
+	sort.Sort(sort.Reverse(mf))
+	for _, migrationFile := range *mf {
+		known = append(known, migrationFile.Version)
+		if migrationFile.Version > version && versions.Contains(migrationFile.Version) {
+			if migrationFile.DownFile == nil {
+				return nil, fmt.Errorf("Unable to roll back version %d: missing down migration file", migrationFile.Version)
+			}
+			files = append(files, *migrationFile.DownFile)
+		}
+	}
+	for _, v := range versions {
+		if v > version && !known.Contains(v) {
+			return nil, fmt.Errorf("Unable to roll back version %d: missing migration files", v)
+		}
+	}
+
+	sort.Sort(mf)
+	for _, migrationFile := range *mf {
+		if migrationFile.Version <= version && !versions.Contains(migrationFile.Version) {
+			if migrationFile.UpFile == nil {
+				return nil, fmt.Errorf("Unable to apply version %d: missing up migration file", migrationFile.Version)
+			}
+			files = append(files, *migrationFile.UpFile)
+		}
+	}
+	return files, nil
+}
+
+// contains checks if there are migration files for version.
+func (mf MigrationFiles) contains(version Version) bool {
+	for _, migrationFile := range mf {
+		if migrationFile.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
 // ReadMigrationFiles reads all migration files from a given path.
 func ReadMigrationFiles(path string, filenameRegex *regexp.Regexp) (files MigrationFiles, err error) {
-	// find all migration files in path.
-	ioFiles, err := ioutil.ReadDir(path)
+	return ReadSourceMigrationFiles(Dir(path), filenameRegex)
+}
+
+// ReadSourceMigrationFiles reads all migration files of source.
+// Their content is read from source when needed, except for single
+// file migrations which are read to find their up and down sections.
+func ReadSourceMigrationFiles(source Source, filenameRegex *regexp.Regexp) (files MigrationFiles, err error) {
+	// find all migration files in source.
+	fileNames, err := source.FileNames()
 	if err != nil {
 		return nil, err
 	}
+	var path string
+	if dir, ok := source.(Dir); ok {
+		path = string(dir)
+	}
 	type tmpFile struct {
 		version  Version
 		name     string
 		filename string
 		d        direction.Direction
+		source   Source
 	}
 	tmpFiles := make([]*tmpFile, 0)
 	tmpFileMap := map[Version]map[direction.Direction]tmpFile{}
-	for _, file := range ioFiles {
+	for _, fileName := range fileNames {
 
-		version, name, d, err := parseFilenameSchema(file.Name(), filenameRegex)
-		if err == nil {
+		version, name, d, err := parseFilenameSchema(fileName, filenameRegex)
+		if err != nil {
+			continue
+		}
+		found := []tmpFile{{version, name, fileName, d, source}}
+		if d == 0 {
+			// single file migration, with up and down sections
+			content, err := source.ReadFile(fileName)
+			if err != nil {
+				return nil, err
+			}
+			sections, err := splitSections(content)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", fileName, err)
+			}
+			found = found[:0]
+			for _, sd := range []direction.Direction{direction.Up, direction.Down} {
+				if _, ok := sections[sd]; ok {
+					found = append(found, tmpFile{version, name, fileName, sd, sectionSource{source, sd}})
+				}
+			}
+		}
+		for _, f := range found {
 			if _, ok := tmpFileMap[version]; !ok {
 				tmpFileMap[version] = map[direction.Direction]tmpFile{}
 			}
-			if existing, ok := tmpFileMap[version][d]; !ok {
-				tmpFileMap[version][d] = tmpFile{version: version, name: name, filename: file.Name(), d: d}
+			if existing, ok := tmpFileMap[version][f.d]; !ok {
+				tmpFileMap[version][f.d] = f
 			} else {
-				return nil, fmt.Errorf("duplicate migration file version %d : %q and %q", version, existing.filename, file.Name())
+				return nil, fmt.Errorf("duplicate migration file version %d : %q and %q", version, existing.filename, fileName)
 			}
-			tmpFiles = append(tmpFiles, &tmpFile{version, name, file.Name(), d})
+			tmpFiles = append(tmpFiles, &tmpFile{f.version, f.name, f.filename, f.d, f.source})
 		}
 	}
 
@@ -207,6 +333,7 @@ func ReadMigrationFiles(path string, filenameRegex *regexp.Regexp) (files Migrat
 			case direction.Up:
 				migrationFile.UpFile = &File{
 					Path:      path,
+					Source:    file.source,
 					FileName:  file.filename,
 					Version:   file.version,
 					Name:      file.name,
@@ -217,6 +344,7 @@ func ReadMigrationFiles(path string, filenameRegex *regexp.Regexp) (files Migrat
 			case direction.Down:
 				migrationFile.DownFile = &File{
 					Path:      path,
+					Source:    file.source,
 					FileName:  file.filename,
 					Version:   file.version,
 					Name:      file.name,
@@ -234,6 +362,7 @@ func ReadMigrationFiles(path string, filenameRegex *regexp.Regexp) (files Migrat
 					case direction.Up:
 						migrationFile.UpFile = &File{
 							Path:      path,
+							Source:    file2.source,
 							FileName:  file2.filename,
 							Version:   file.version,
 							Name:      file2.name,
@@ -243,6 +372,7 @@ func ReadMigrationFiles(path string, filenameRegex *regexp.Regexp) (files Migrat
 					case direction.Down:
 						migrationFile.DownFile = &File{
 							Path:      path,
+							Source:    file2.source,
 							FileName:  file2.filename,
 							Version:   file.version,
 							Name:      file2.name,
@@ -264,6 +394,7 @@ func ReadMigrationFiles(path string, filenameRegex *regexp.Regexp) (files Migrat
 }
 
 // parseFilenameSchema parses the filename.
+// The direction is 0 for single file migrations.
 func parseFilenameSchema(filename string, filenameRegex *regexp.Regexp) (version Version, name string, d direction.Direction, err error) {
 	matches := filenameRegex.FindStringSubmatch(filename)
 	if len(matches) != 4 {
@@ -280,7 +411,7 @@ func parseFilenameSchema(filename string, filenameRegex *regexp.Regexp) (version
 		d = direction.Up
 	} else if matches[3] == "down" {
 		d = direction.Down
-	} else {
+	} else if matches[3] != "" {
 		return 0, "", 0, errors.New(fmt.Sprintf("Unable to parse up|down '%v' in filename schema", matches[3]))
 	}
 
@@ -1,10 +1,14 @@
 package file
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/gemnasium/migrate/migrate/direction"
 )
@@ -24,7 +28,8 @@ func TestParseFilenameSchema(t *testing.T) {
 		{"-1_test_file.down.sql", "sql", 0, "", direction.Up, true},
 		{"test_file.down.sql", "sql", 0, "", direction.Up, true},
 		{"100_test_file.down", "sql", 0, "", direction.Up, true},
-		{"100_test_file.sql", "sql", 0, "", direction.Up, true},
+		{"100_test_file.sql", "sql", 100, "test_file", 0, false},
+		{"100_test_file.upper.sql", "sql", 100, "test_file.upper", 0, false},
 		{"100_test_file", "sql", 0, "", direction.Up, true},
 		{"test_file", "sql", 0, "", direction.Up, true},
 		{"100", "sql", 0, "", direction.Up, true},
@@ -187,6 +192,71 @@ func TestFiles(t *testing.T) {
 	}
 }
 
+func TestGoto(t *testing.T) {
+	// there are the following versions:
+	// 1(up&down), 2(up&down), 101(up&down), 301(up), 401(down)
+	up := func(v Version) *File { return &File{Version: v, Direction: direction.Up} }
+	down := func(v Version) *File { return &File{Version: v, Direction: direction.Down} }
+	files := MigrationFiles{
+		{Version: 1, UpFile: up(1), DownFile: down(1)},
+		{Version: 2, UpFile: up(2), DownFile: down(2)},
+		{Version: 101, UpFile: up(101), DownFile: down(101)},
+		{Version: 301, UpFile: up(301)},
+		{Version: 401, DownFile: down(401)},
+	}
+
+	var tests = []struct {
+		appliedVersions Versions
+		version         Version
+		expectFiles     Files
+		expectErr       bool
+	}{
+		{Versions{}, 2, Files{*up(1), *up(2)}, false},
+		{Versions{}, 0, Files{}, false},
+		{Versions{1}, 101, Files{*up(2), *up(101)}, false},
+		{Versions{101, 2, 1}, 1, Files{*down(101), *down(2)}, false},
+		{Versions{101, 2, 1}, 0, Files{*down(101), *down(2), *down(1)}, false},
+		{Versions{101, 1}, 2, Files{*down(101), *up(2)}, false},
+		{Versions{2, 1}, 2, Files{}, false},
+		{Versions{}, 3, nil, true},
+		{Versions{}, 401, nil, true},
+		{Versions{301, 101, 2, 1}, 2, nil, true},
+		{Versions{500, 1}, 1, nil, true},
+	}
+
+	for _, test := range tests {
+		gotoFiles, err := files.Goto(test.version, test.appliedVersions)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("file.Goto(%d, %v): expected error, got none", test.version, test.appliedVersions)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("file.Goto(%d, %v): unexpected error: %v", test.version, test.appliedVersions, err)
+			continue
+		}
+		if !reflect.DeepEqual(gotoFiles, test.expectFiles) {
+			t.Errorf("file.Goto(%d, %v): expected %v, got %v", test.version, test.appliedVersions, test.expectFiles, gotoFiles)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	f := File{Content: []byte("CREATE TABLE t (id int);\n")}
+	checksum, err := f.Checksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checksum) != 64 {
+		t.Fatalf("Expected a hex encoded SHA-256, got %q", checksum)
+	}
+	other := File{Content: []byte("CREATE TABLE t (id bigint);\n")}
+	if otherChecksum, _ := other.Checksum(); otherChecksum == checksum {
+		t.Fatal("Expected different contents to have different checksums")
+	}
+}
+
 func TestDuplicateFiles(t *testing.T) {
 	dups := []string{
 		"001_migration.up.sql",
@@ -206,6 +276,182 @@ func TestDuplicateFiles(t *testing.T) {
 	}
 }
 
+func TestFSSource(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/001_init.up.sql":     {Data: []byte("CREATE TABLE t (id int);")},
+		"migrations/001_init.down.sql":   {Data: []byte("DROP TABLE t;")},
+		"migrations/README.md":           {Data: []byte("not a migration")},
+		"migrations/nested/002_x.up.sql": {Data: []byte("SELECT 1;")},
+	}
+
+	files, err := ReadSourceMigrationFiles(FS(fsys, "migrations"), FilenameRegex("sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Version != 1 {
+		t.Fatalf("Expected version 1 only, got %v", files)
+	}
+	if err := files[0].DownFile.ReadContent(); err != nil {
+		t.Fatal(err)
+	}
+	if string(files[0].DownFile.Content) != "DROP TABLE t;" {
+		t.Errorf("Unexpected content %q", files[0].DownFile.Content)
+	}
+
+	if _, err := ReadSourceMigrationFiles(FS(fsys, "missing"), FilenameRegex("sql")); err == nil {
+		t.Error("Expected an error reading a missing directory")
+	}
+}
+
+func TestSingleFileMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"001_both.sql":     {Data: []byte("-- create t\n-- +migrate Up\nCREATE TABLE t (id int);\n\n-- +migrate Down\nDROP TABLE t;\n")},
+		"002_up_only.sql":  {Data: []byte("# +MIGRATE UP\nCREATE TABLE u (id int);\n")},
+		"003_split.up.sql": {Data: []byte("CREATE TABLE v (id int);")},
+	}
+	files, err := ReadSourceMigrationFiles(FS(fsys, "."), FilenameRegex("sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected 3 migrations, got %v", files)
+	}
+	both := files[0]
+	if both.UpFile == nil || both.DownFile == nil || both.UpFile.FileName != "001_both.sql" || both.UpFile.Name != "both" {
+		t.Fatalf("Expected up and down files for 001_both.sql, got %+v", both)
+	}
+	for _, f := range []*File{both.UpFile, both.DownFile} {
+		if err := f.ReadContent(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(both.UpFile.Content) != "CREATE TABLE t (id int);\n\n" || string(both.DownFile.Content) != "DROP TABLE t;\n" {
+		t.Errorf("Unexpected sections %q and %q", both.UpFile.Content, both.DownFile.Content)
+	}
+	if files[1].UpFile == nil || files[1].DownFile != nil {
+		t.Errorf("Expected an up file only for 002_up_only.sql, got %+v", files[1])
+	}
+
+	for name, content := range map[string]string{
+		"004_no_marker.sql": "CREATE TABLE w (id int);",
+		"004_before.sql":    "SELECT 1;\n-- +migrate Up\n",
+		"004_twice.sql":     "-- +migrate Up\n-- +migrate Up\n",
+		"003_split.sql":     "-- +migrate Up\nCREATE TABLE v (id int);",
+	} {
+		invalid := fstest.MapFS{name: {Data: []byte(content)}, "003_split.up.sql": fsys["003_split.up.sql"]}
+		if _, err := ReadSourceMigrationFiles(FS(invalid, "."), FilenameRegex("sql")); err == nil {
+			t.Errorf("Expected an error reading %s", name)
+		}
+	}
+}
+
+func TestJoinSections(t *testing.T) {
+	content := JoinSections("sql", []byte("CREATE TABLE t (id int);\n"), []byte("DROP TABLE t;\n"))
+	sections, err := splitSections(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sections[direction.Up]) != "CREATE TABLE t (id int);\n\n" || string(sections[direction.Down]) != "DROP TABLE t;\n" {
+		t.Errorf("Unexpected sections %q", sections)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"ROLE": "app", "SCHEMA": "tenant1"}
+	lookup := func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+	var tests = []struct {
+		content   string
+		expected  string
+		expectErr bool
+	}{
+		{"GRANT ALL ON ${SCHEMA}.t TO ${ROLE};", "GRANT ALL ON tenant1.t TO app;", false},
+		{"SELECT '$${ROLE}', $1, $$body$$;", "SELECT '${ROLE}', $1, $$body$$;", false},
+		{"GRANT ALL TO ${UNDEFINED};", "", true},
+		{"SELECT '${not a name}';", "", true},
+	}
+	for _, test := range tests {
+		f := File{FileName: "001_test.up.sql", Content: []byte(test.content)}
+		checksum, _ := f.Checksum()
+		err := f.Expand(lookup)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("Expand(%q): expected error, got none", test.content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expand(%q): unexpected error: %v", test.content, err)
+			continue
+		}
+		if string(f.Content) != test.expected {
+			t.Errorf("Expand(%q): expected %q, got %q", test.content, test.expected, f.Content)
+		}
+		if expandedChecksum, _ := f.Checksum(); expandedChecksum != checksum {
+			t.Errorf("Expand(%q): expected the checksum to remain the same", test.content)
+		}
+	}
+}
+
+func TestPosition(t *testing.T) {
+	content := "-- +migrate Up\nCREATE SCHEMA ${SCHEMA};\nGRANT ALL ON SCHEMA ${SCHEMA} TO app;\n-- +migrate Down\nDROP SCHEMA ${SCHEMA};\n"
+	fsys := fstest.MapFS{"001_schema.sql": {Data: []byte(content)}}
+	files, err := ReadSourceMigrationFiles(FS(fsys, "."), FilenameRegex("sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(name string) (string, bool) { return "tenant_schema", true }
+
+	up := files[0].UpFile
+	if err := up.Expand(lookup); err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Index(string(up.Content), "tenant")
+	grant := strings.Index(string(up.Content), "GRANT")
+	var tests = []struct {
+		offset       int
+		line, column int
+	}{
+		{0, 2, 1},           // CREATE
+		{value + 3, 2, 15},  // inside a value: its placeholder
+		{grant, 3, 1},       // after a value
+		{grant + 34, 3, 31}, // after two values: " TO"
+	}
+	for _, test := range tests {
+		if line, column := up.Position(test.offset); line != test.line || column != test.column {
+			t.Errorf("Position(%d): expected %d:%d, got %d:%d", test.offset, test.line, test.column, line, column)
+		}
+	}
+
+	down := files[0].DownFile
+	if err := down.ReadContent(); err != nil {
+		t.Fatal(err)
+	}
+	if line, column := down.Position(5); line != 5 || column != 6 {
+		t.Errorf("Expected the down section to start on line 5, got %d:%d", line, column)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	files := MigrationFiles{{Version: 1}, {Version: 3}}
+	merged, err := files.Merge(NewFuncMigration(2, "func", nil, func(ctx context.Context, tx Tx) error { return nil }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != 3 || merged[1].Version != 2 {
+		t.Fatalf("Expected version 2 to be merged in order, got %v", merged)
+	}
+	if merged[1].UpFile != nil || merged[1].DownFile.FileName != "2_func.down.go" || merged[1].DownFile.Func == nil {
+		t.Fatalf("Unexpected Go migration %+v", merged[1])
+	}
+
+	if _, err := files.Merge(NewFuncMigration(3, "func", nil, nil)); err == nil {
+		t.Fatal("Expected duplicate migration version error")
+	}
+}
+
 // makeFiles takes an identifier, and a list of file names and uses them to create a temporary
 // directory populated with files named with the names passed in.  makeFiles returns the root
 // directory name, and a func suitable for a defer cleanup to remove the temporary files after
@@ -0,0 +1,62 @@
+package file
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/gemnasium/migrate/migrate/direction"
+)
+
+// Tx is the part of *sql.Tx available to Go migrations.
+// *sql.DB satisfies it too, for drivers without transactions.
+type Tx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Func is a migration written in Go. Drivers running migrations in a
+// transaction pass it that transaction.
+type Func func(ctx context.Context, tx Tx) error
+
+// NewFuncMigration returns the migration file of version running up and
+// down instead of file contents. Either function can be nil.
+func NewFuncMigration(version Version, name string, up, down Func) MigrationFile {
+	mf := MigrationFile{Version: version}
+	if up != nil {
+		mf.UpFile = &File{
+			FileName:  fmt.Sprintf("%d_%s.up.go", version, name),
+			Version:   version,
+			Name:      name,
+			Direction: direction.Up,
+			Func:      up,
+		}
+	}
+	if down != nil {
+		mf.DownFile = &File{
+			FileName:  fmt.Sprintf("%d_%s.down.go", version, name),
+			Version:   version,
+			Name:      name,
+			Direction: direction.Down,
+			Func:      down,
+		}
+	}
+	return mf
+}
+
+// Merge returns the migration files of mf and migrations, sorted by version.
+// A version can't be both in mf and migrations.
+func (mf MigrationFiles) Merge(migrations ...MigrationFile) (MigrationFiles, error) {
+	merged := make(MigrationFiles, 0, len(mf)+len(migrations))
+	merged = append(merged, mf...)
+	for _, migration := range migrations {
+		if merged.contains(migration.Version) {
+			return nil, fmt.Errorf("duplicate migration version %d", migration.Version)
+		}
+		merged = append(merged, migration)
+	}
+	sort.Sort(merged)
+	return merged, nil
+}
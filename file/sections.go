@@ -0,0 +1,102 @@
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/gemnasium/migrate/migrate/direction"
+)
+
+// sectionMarkerRegex matches the lines starting the up and down
+// sections of single file migrations, such as "-- +migrate Up".
+var sectionMarkerRegex = regexp.MustCompile(`(?i)^\s*(?:--|#|//)\s*\+migrate\s+(up|down)\s*$`)
+
+// splitSections splits the content of a single file migration into
+// its up and down sections. Sections without marker are left out.
+// Only comments and blank lines can precede the first marker.
+func splitSections(content []byte) (map[direction.Direction][]byte, error) {
+	sections := make(map[direction.Direction][]byte)
+	var current direction.Direction
+	var section bytes.Buffer
+	flush := func() {
+		if current != 0 {
+			sections[current] = append([]byte(nil), section.Bytes()...)
+		}
+		section.Reset()
+	}
+	for i, line := range bytes.SplitAfter(content, []byte("\n")) {
+		if matches := sectionMarkerRegex.FindSubmatch(bytes.TrimRight(line, "\r\n")); matches != nil {
+			flush()
+			current = direction.Up
+			if bytes.EqualFold(matches[1], []byte("down")) {
+				current = direction.Down
+			}
+			if _, ok := sections[current]; ok {
+				return nil, fmt.Errorf("line %d: duplicate %s marker", i+1, matches[1])
+			}
+			continue
+		}
+		if _, ok := commentText(string(line)); current == 0 && !ok {
+			return nil, fmt.Errorf("line %d: statement before the first +migrate Up or Down marker", i+1)
+		}
+		section.Write(line)
+	}
+	flush()
+	if len(sections) == 0 {
+		return nil, fmt.Errorf("no +migrate Up or Down marker")
+	}
+	return sections, nil
+}
+
+// JoinSections returns the content of a single file migration made of
+// up and down, with markers commented for filenameExtension.
+func JoinSections(filenameExtension string, up, down []byte) []byte {
+	comment := "--"
+	if filenameExtension == "sh" {
+		comment = "#"
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s +migrate Up\n", comment)
+	buf.Write(up)
+	fmt.Fprintf(&buf, "\n%s +migrate Down\n", comment)
+	buf.Write(down)
+	return buf.Bytes()
+}
+
+// sectionSource reads one section of the single file migrations of
+// a Source.
+type sectionSource struct {
+	Source
+	direction direction.Direction
+}
+
+func (s sectionSource) ReadFile(name string) ([]byte, error) {
+	section, _, err := s.readSection(name)
+	return section, err
+}
+
+// readSection returns the section of the file name, and the number of
+// lines preceding it in the file.
+func (s sectionSource) readSection(name string) (section []byte, lineOffset int, err error) {
+	content, err := s.Source.ReadFile(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	sections, err := splitSections(content)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %v", name, err)
+	}
+	marker := []byte("up")
+	if s.direction == direction.Down {
+		marker = []byte("down")
+	}
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		matches := sectionMarkerRegex.FindSubmatch(bytes.TrimRight(line, "\r"))
+		if matches != nil && bytes.EqualFold(matches[1], marker) {
+			lineOffset = i + 1
+			break
+		}
+	}
+	return sections[s.direction], lineOffset, nil
+}
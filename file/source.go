@@ -0,0 +1,67 @@
+package file
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"path"
+)
+
+// Source lists and reads migration files.
+type Source interface {
+	// FileNames returns the names of the files of the source.
+	// Files not named after a migration are ignored.
+	FileNames() ([]string, error)
+
+	// ReadFile returns the content of the named file.
+	ReadFile(name string) ([]byte, error)
+}
+
+// Dir is the Source of the files of a directory.
+type Dir string
+
+// FileNames returns the names of the files in the directory.
+func (d Dir) FileNames() ([]string, error) {
+	ioFiles, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(ioFiles))
+	for _, ioFile := range ioFiles {
+		names = append(names, ioFile.Name())
+	}
+	return names, nil
+}
+
+// ReadFile reads the named file of the directory.
+func (d Dir) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(path.Join(string(d), name))
+}
+
+// FS returns the Source of the files in dir of fsys, such as an
+// embed.FS or a fstest.MapFS. Use "." for the root of fsys.
+func FS(fsys fs.FS, dir string) Source {
+	return fsSource{fsys: fsys, dir: dir}
+}
+
+type fsSource struct {
+	fsys fs.FS
+	dir  string
+}
+
+func (s fsSource) FileNames() ([]string, error) {
+	entries, err := fs.ReadDir(s.fsys, s.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s fsSource) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(s.fsys, path.Join(s.dir, name))
+}
@@ -0,0 +1,98 @@
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+// varRegex matches ${NAME} placeholders, and $${NAME} escapes.
+var varRegex = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// varNameRegex matches valid variable names.
+var varNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Expand replaces the ${NAME} placeholders of the content with the value
+// lookup returns for NAME, reading the content first if needed.
+// $${NAME} is left as ${NAME}. Placeholders without value are an error.
+// The checksum of the file remains the one of the original content.
+func (f *File) Expand(lookup func(name string) (string, bool)) error {
+	if err := f.ReadContent(); err != nil {
+		return err
+	}
+	expanded, substitutions, err := expandVars(f.Content, lookup)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.FileName, err)
+	}
+	if f.original == nil {
+		f.original = f.Content
+		f.substitutions = substitutions
+	}
+	f.Content = expanded
+	return nil
+}
+
+// substitution is a placeholder replaced by Expand.
+type substitution struct {
+	offset      int // offset of the value in the expanded content
+	length      int // length of the value
+	placeholder int // length of the placeholder
+}
+
+func expandVars(content []byte, lookup func(name string) (string, bool)) ([]byte, []substitution, error) {
+	var expanded bytes.Buffer
+	var substitutions []substitution
+	last := 0
+	for _, loc := range varRegex.FindAllSubmatchIndex(content, -1) {
+		expanded.Write(content[last:loc[0]])
+		last = loc[1]
+		placeholder := content[loc[0]:loc[1]]
+		value := string(placeholder[1:])
+		if !bytes.HasPrefix(placeholder, []byte("$$")) {
+			name := string(content[loc[2]:loc[3]])
+			line, column := LineColumnFromOffset(content, loc[0])
+			if !varNameRegex.MatchString(name) {
+				return nil, nil, fmt.Errorf("line %d column %d: invalid variable name %q", line, column, name)
+			}
+			var ok bool
+			if value, ok = lookup(name); !ok {
+				return nil, nil, fmt.Errorf("line %d column %d: undefined variable %s", line, column, name)
+			}
+		}
+		substitutions = append(substitutions, substitution{expanded.Len(), len(value), len(placeholder)})
+		expanded.WriteString(value)
+	}
+	expanded.Write(content[last:])
+	return expanded.Bytes(), substitutions, nil
+}
+
+// Position returns the line and column, starting at 1, of the byte at
+// offset in the content of f, counted in the file the content was read
+// from: before variables were substituted, and from the top of the file
+// for single file migrations. Offsets within a substituted value point
+// at its placeholder.
+func (f *File) Position(offset int) (line, column int) {
+	content := f.Content
+	if f.original != nil {
+		content = f.original
+		shift := 0
+		for _, s := range f.substitutions {
+			if offset < s.offset {
+				break
+			}
+			if offset < s.offset+s.length {
+				offset = s.offset
+				break
+			}
+			shift += s.placeholder - s.length
+		}
+		offset += shift
+	}
+	if offset < 0 {
+		offset = 0
+	} else if offset > len(content) {
+		offset = len(content)
+	}
+	line, column = LineColumnFromOffset(content, offset)
+	return line + f.lineOffset, column
+}
@@ -4,28 +4,56 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fatih/color"
+	"github.com/gemnasium/migrate/driver"
 	_ "github.com/gemnasium/migrate/driver/bash"
 	_ "github.com/gemnasium/migrate/driver/cassandra"
 	_ "github.com/gemnasium/migrate/driver/crate"
 	_ "github.com/gemnasium/migrate/driver/mysql"
 	_ "github.com/gemnasium/migrate/driver/postgres"
 	_ "github.com/gemnasium/migrate/driver/sqlite3"
+	"github.com/gemnasium/migrate/event"
 	"github.com/gemnasium/migrate/file"
 	"github.com/gemnasium/migrate/migrate"
 	"github.com/gemnasium/migrate/migrate/direction"
-	pipep "github.com/gemnasium/migrate/pipe"
 )
 
 var url = flag.String("url", os.Getenv("MIGRATE_URL"), "")
 var migrationsPath = flag.String("path", "", "")
+var archivePrefix = flag.String("archive-prefix", "", "Directory of the migration files inside the -path archive")
+var archiveSHA256 = flag.String("archive-sha256", "", "SHA-256 checksum the -path archive must match")
 var version = flag.Bool("version", false, "Show migrate version")
+var dryRun = flag.Bool("dry-run", false, "Print the migrations that would run, without running them")
+var lockTimeout = flag.Duration("lock-timeout", 0, "Give up if the migration lock can't be acquired in time")
+var timeout = flag.Duration("timeout", 0, "Cancel a migration file running longer than this, unless it sets its own migrate:timeout")
+var retries = flag.Int("retries", 0, "Run migration files failing with a transient error again, up to this many times")
+var retryBackoff = flag.Duration("retry-backoff", time.Second, "Wait before the first retry, doubled before each next one")
+var retryJitter = flag.Float64("retry-jitter", 0.2, "Fraction of the retry wait randomly added or removed")
+var txMode = flag.String("tx-mode", "per-file", "Transactions migration files run in: per-file, all or none")
+var jsonOutput = flag.Bool("json", false, "Print status as JSON")
+var ignoreDrift = flag.Bool("ignore-drift", false, "Apply pending migrations even if applied ones were modified")
+var singleFile = flag.Bool("single-file", false, "Create a single migration file with up and down sections")
+var sequential = flag.Bool("sequential", false, "Number created migrations sequentially instead of with a timestamp")
+var digits = flag.Int("digits", 4, "Zero-padding of sequential migration versions")
+var templateDir = flag.String("template-dir", "", "Directory of the templates of new migration files")
+var envVars = flag.Bool("env-vars", false, "Substitute environment variables for the ${NAME} placeholders of migration files")
+var vars = varsFlag{}
+var secretVars namesFlag
+
+func init() {
+	flag.Var(vars, "var", "Value of a ${NAME} placeholder of migration files, as NAME=value")
+	flag.Var(&secretVars, "secret", "Name of a variable whose value is masked in the output")
+}
 
 func main() {
 	flag.Usage = func() {
@@ -52,7 +80,14 @@ func main() {
 			os.Exit(1)
 		}
 
-		migrationFile, err := migrate.Create(*url, *migrationsPath, name)
+		m := openMigrator()
+		m.SingleFile = *singleFile
+		m.TemplateDir = *templateDir
+		m.Sequential = *sequential
+		m.SequenceDigits = *digits
+		m.Sink = event.SinkFunc(printEvent)
+		migrationFile, err := m.Create(name)
+		m.Driver().Close()
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -60,6 +95,9 @@ func main() {
 
 		fmt.Printf("Version %v migration files created in %v:\n", migrationFile.Version, *migrationsPath)
 		fmt.Println(migrationFile.UpFile.FileName)
+		if *singleFile {
+			break
+		}
 		fmt.Println(migrationFile.DownFile.FileName)
 
 	case "migrate":
@@ -70,93 +108,105 @@ func main() {
 			fmt.Println("Unable to parse param <n>.")
 			os.Exit(1)
 		}
-		timerStart = time.Now()
-		pipe := pipep.New()
-		go migrate.Migrate(pipe, *url, *migrationsPath, relativeNInt)
-		ok := writePipe(pipe)
-		printTimer()
-		if !ok {
-			os.Exit(1)
-		}
+		run(func(ctx context.Context, m *migrate.Migrator) (*migrate.Result, error) {
+			return m.Migrate(ctx, relativeNInt)
+		})
 
 	case "goto":
 		verifyMigrationsPath(*migrationsPath)
 		toVersion := flag.Arg(1)
-		toVersionInt, err := strconv.Atoi(toVersion)
-		if err != nil || toVersionInt < 0 {
+		toVersionInt, err := strconv.ParseUint(toVersion, 10, 64)
+		if err != nil {
 			fmt.Println("Unable to parse param <v>.")
 			os.Exit(1)
 		}
+		run(func(ctx context.Context, m *migrate.Migrator) (*migrate.Result, error) {
+			return m.Goto(ctx, file.Version(toVersionInt))
+		})
+
+	case "up":
+		verifyMigrationsPath(*migrationsPath)
+		run(func(ctx context.Context, m *migrate.Migrator) (*migrate.Result, error) {
+			return m.Up(ctx)
+		})
+
+	case "down":
+		verifyMigrationsPath(*migrationsPath)
+		run(func(ctx context.Context, m *migrate.Migrator) (*migrate.Result, error) {
+			return m.Down(ctx)
+		})
 
-		currentVersion, err := migrate.Version(*url, *migrationsPath)
+	case "redo":
+		verifyMigrationsPath(*migrationsPath)
+		run(func(ctx context.Context, m *migrate.Migrator) (*migrate.Result, error) {
+			return m.Redo(ctx)
+		})
+
+	case "reset":
+		verifyMigrationsPath(*migrationsPath)
+		run(func(ctx context.Context, m *migrate.Migrator) (*migrate.Result, error) {
+			return m.Reset(ctx)
+		})
+
+	case "version":
+		verifyMigrationsPath(*migrationsPath)
+		m := openMigrator()
+		version, err := m.Version(context.Background())
+		m.Driver().Close()
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
+		fmt.Println(version)
 
-		relativeNInt := toVersionInt - int(currentVersion)
-
-		timerStart = time.Now()
-		pipe := pipep.New()
-		go migrate.Migrate(pipe, *url, *migrationsPath, relativeNInt)
-		ok := writePipe(pipe)
-		printTimer()
-		if !ok {
+	case "status":
+		verifyMigrationsPath(*migrationsPath)
+		m := openMigrator()
+		statuses, err := m.Status(context.Background())
+		m.Driver().Close()
+		if err != nil {
+			fmt.Println(err)
 			os.Exit(1)
 		}
-
-	case "up":
-		verifyMigrationsPath(*migrationsPath)
-		timerStart = time.Now()
-		pipe := pipep.New()
-		go migrate.Up(pipe, *url, *migrationsPath)
-		ok := writePipe(pipe)
-		printTimer()
-		if !ok {
+		if *jsonOutput {
+			err = json.NewEncoder(os.Stdout).Encode(statuses)
+		} else {
+			err = migrate.WriteStatus(os.Stdout, statuses)
+		}
+		if err != nil {
+			fmt.Println(err)
 			os.Exit(1)
 		}
 
-	case "down":
+	case "verify":
 		verifyMigrationsPath(*migrationsPath)
-		timerStart = time.Now()
-		pipe := pipep.New()
-		go migrate.Down(pipe, *url, *migrationsPath)
-		ok := writePipe(pipe)
-		printTimer()
-		if !ok {
+		m := openMigrator()
+		drift, err := m.Verify(context.Background())
+		m.Driver().Close()
+		if err != nil {
+			fmt.Println(err)
 			os.Exit(1)
 		}
-
-	case "redo":
-		verifyMigrationsPath(*migrationsPath)
-		timerStart = time.Now()
-		pipe := pipep.New()
-		go migrate.Redo(pipe, *url, *migrationsPath)
-		ok := writePipe(pipe)
-		printTimer()
-		if !ok {
+		printDrift(drift)
+		if drift.Detected() {
 			os.Exit(1)
 		}
 
-	case "reset":
+	case "dirty":
 		verifyMigrationsPath(*migrationsPath)
-		timerStart = time.Now()
-		pipe := pipep.New()
-		go migrate.Reset(pipe, *url, *migrationsPath)
-		ok := writePipe(pipe)
-		printTimer()
-		if !ok {
-			os.Exit(1)
+		if status := dirtyCmd(); status != 0 {
+			os.Exit(status)
 		}
 
-	case "version":
+	case "force-unlock":
 		verifyMigrationsPath(*migrationsPath)
-		version, err := migrate.Version(*url, *migrationsPath)
+		m := openMigrator()
+		err := m.ForceUnlock(context.Background())
+		m.Driver().Close()
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
-		fmt.Println(version)
 
 	default:
 		helpCmd()
@@ -166,44 +216,197 @@ func main() {
 	}
 }
 
-func writePipe(pipe chan interface{}) (ok bool) {
-	okFlag := true
-	if pipe != nil {
-		for {
-			select {
-			case item, more := <-pipe:
-				if !more {
-					return okFlag
-				} else {
-					switch item.(type) {
+// run opens the driver, runs fn while printing its progress and
+// exits with a non-zero status if the migration failed.
+// The first ^C cancels the migration, the second one quits immediately.
+func run(fn func(ctx context.Context, m *migrate.Migrator) (*migrate.Result, error)) {
+	d, err := driver.New(*url)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleInterrupts(cancel)
+
+	timerStart = time.Now()
+	m := newMigrator(d)
+	m.Sink = event.SinkFunc(printEvent)
+	m.DryRun = *dryRun
+	m.LockTimeout = *lockTimeout
+	m.Timeout = *timeout
+	m.Retry = migrate.RetryPolicy{Attempts: *retries + 1, Backoff: *retryBackoff, Jitter: *retryJitter}
+	m.TransactionMode = migrate.TransactionMode(*txMode)
+	m.IgnoreDrift = *ignoreDrift
+	if len(vars) > 0 {
+		m.Vars = vars
+	}
+	m.EnvVars = *envVars
+	m.SecretVars = secretVars
+	r, err := fn(ctx, m)
+	// the Migrator already emitted the errors of its runs
+	if err != nil && r == nil {
+		printEvent(event.Event{Kind: event.Error, Err: err})
+	}
+	if err := d.Close(); err != nil {
+		printEvent(event.Event{Kind: event.Error, Err: err})
+	}
+	if *dryRun {
+		if err == nil {
+			err = migrate.WritePlan(os.Stdout, r.Files)
+		}
+	} else {
+		printTimer()
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// dirtyCmd lists the dirty versions, or clears the dirty state of one
+// with "dirty clear <v> [applied|pending]", and returns the exit status.
+// It returns instead of exiting so that the driver is closed first.
+func dirtyCmd() int {
+	if flag.Arg(1) == "clear" {
+		dirtyVersion, err := strconv.ParseUint(flag.Arg(2), 10, 64)
+		if err != nil {
+			fmt.Println("Unable to parse param <v>.")
+			return 1
+		}
+		state := flag.Arg(3)
+		if state != "" && state != "applied" && state != "pending" {
+			fmt.Println("Please specify applied or pending.")
+			return 1
+		}
+		m := openMigrator()
+		defer m.Driver().Close()
+		if err := m.ClearDirty(context.Background(), file.Version(dirtyVersion), state != "pending"); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		return 0
+	}
+
+	m := openMigrator()
+	defer m.Driver().Close()
+	dirty, err := m.Dirty(context.Background())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	for _, v := range dirty {
+		fmt.Println(v)
+	}
+	if len(dirty) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// varsFlag collects the NAME=value pairs of repeated flags.
+type varsFlag map[string]string
 
-					case string:
-						fmt.Println(item.(string))
+func (v varsFlag) String() string {
+	pairs := make([]string, 0, len(v))
+	for name, value := range v {
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
 
-					case error:
-						c := color.New(color.FgRed)
-						c.Println(item.(error).Error(), "\n")
-						okFlag = false
+func (v varsFlag) Set(pair string) error {
+	parts := strings.SplitN(pair, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected NAME=value, got %q", pair)
+	}
+	v[parts[0]] = parts[1]
+	return nil
+}
 
-					case file.File:
-						f := item.(file.File)
-						c := color.New(color.FgBlue)
-						if f.Direction == direction.Up {
-							c.Print(">")
-						} else if f.Direction == direction.Down {
-							c.Print("<")
-						}
-						fmt.Printf(" %s\n", f.FileName)
+// namesFlag collects the values of repeated flags.
+type namesFlag []string
 
-					default:
-						text := fmt.Sprint(item)
-						fmt.Println(text)
-					}
-				}
-			}
+func (n *namesFlag) String() string {
+	return strings.Join(*n, ",")
+}
+
+func (n *namesFlag) Set(name string) error {
+	*n = append(*n, name)
+	return nil
+}
+
+// openMigrator opens the driver and returns a Migrator for it.
+// Closing the driver is up to the caller.
+func openMigrator() *migrate.Migrator {
+	d, err := driver.New(*url)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return newMigrator(d)
+}
+
+// newMigrator returns a Migrator reading the migration files of -path,
+// a directory or an archive, and applying them with d.
+func newMigrator(d driver.Driver) *migrate.Migrator {
+	source := file.PathSource(*migrationsPath)
+	if archive, ok := source.(*file.Archive); ok {
+		archive.Prefix = *archivePrefix
+		archive.SHA256 = *archiveSHA256
+	}
+	return migrate.NewSourceMigrator(d, source)
+}
+
+// handleInterrupts calls cancel on the first ^C
+// and exits on the second one.
+func handleInterrupts(cancel context.CancelFunc) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		// add white space at beginning for ^C splitting
+		fmt.Println(" Aborting ... Hit again to force quit.")
+		cancel()
+		<-c
+		os.Exit(5)
+	}()
+}
+
+func printEvent(e event.Event) {
+	switch e.Kind {
+	case event.MigrationStarted:
+		c := color.New(color.FgBlue)
+		if e.File.Direction == direction.Up {
+			c.Print(">")
+		} else if e.File.Direction == direction.Down {
+			c.Print("<")
 		}
+		fmt.Printf(" %s\n", e.File.FileName)
+
+	case event.Warning, event.Interrupted:
+		fmt.Println(e.Message)
+
+	case event.Error:
+		c := color.New(color.FgRed)
+		c.Printf("%s\n\n", e.Err.Error())
+	}
+}
+
+func printDrift(d *migrate.Drift) {
+	red := color.New(color.FgRed)
+	for _, v := range d.Modified {
+		red.Printf("modified %d\n", v)
+	}
+	for _, v := range d.Missing {
+		red.Printf("missing  %d\n", v)
+	}
+	for _, v := range d.Unknown {
+		fmt.Printf("unknown  %d\n", v)
+	}
+	if !d.Detected() {
+		fmt.Println("Applied migrations match the migration files.")
 	}
-	return okFlag
 }
 
 func verifyMigrationsPath(path string) {
@@ -226,7 +429,10 @@ func printTimer() {
 
 func helpCmd() {
 	os.Stderr.WriteString(
-		`usage: migrate [-path=<path>] -url=<url> <command> [<args>]
+		`usage: migrate [-path=<path>] -url=<url> [-dry-run] [-lock-timeout=<duration>] [-timeout=<duration>]
+       [-retries=<n>] [-retry-backoff=<duration>] [-retry-jitter=<fraction>] [-tx-mode=<mode>] [-ignore-drift] [-json] [-single-file] [-template-dir=<dir>]
+       [-sequential] [-digits=<n>] [-var=<NAME=value>...] [-env-vars] [-secret=<NAME>...]
+       [-archive-prefix=<dir>] [-archive-sha256=<checksum>] <command> [<args>]
 
 Commands:
    create <name>  Create a new migration
@@ -235,10 +441,44 @@ Commands:
    reset          Down followed by Up
    redo           Roll back most recent migration, then apply it again
    version        Show current migration version
+   status         List migrations, applied or pending
+   verify         Check applied migrations against migration files
+   dirty          List migrations which didn't complete
+   dirty clear <v> [applied|pending]
+                  Clear the dirty state of version v once the database is
+                  fixed, keeping it applied (default) or making it pending
+   force-unlock   Release the migration lock left behind by a killed run
    migrate <n>    Apply migrations -n|+n
    goto <v>       Migrate to version v
    help           Show this help
 
-'-path' defaults to current working directory.
+'-path' defaults to current working directory. It can also be a .tar, .tar.gz,
+.tgz or .zip archive, with the migration files in '-archive-prefix' (the root
+by default), checked against '-archive-sha256' if given.
+'-dry-run' prints the migrations up, down, redo, reset, migrate and goto
+would run, with their content, without running them.
+'-lock-timeout' limits the wait for other migration runs, e.g. 30s. No limit by default.
+'-timeout' cancels a migration file running longer than this, e.g. 5m, and rolls
+it back where possible. A '-- migrate:timeout=<duration>' directive overrides it.
+'-retries' runs migration files failing with a transient error, such as a deadlock,
+again up to n times, waiting '-retry-backoff' (1s by default) doubled each time,
+give or take '-retry-jitter' (0.2 by default) of it. Only files run in a
+transaction are retried, unless they set '-- migrate:retries=<n>'.
+'-tx-mode' is per-file (default) to run each migration file in its own transaction,
+all to apply all of them or none in a single transaction, or none to run them
+outside of any transaction. all and none need the postgres or sqlite3 driver.
+'-json' prints status as JSON instead of a table.
+'-ignore-drift' lets up run even if verify reports modified or missing migrations.
+'-single-file' makes create write one file with "-- +migrate Up" and
+"-- +migrate Down" sections instead of an up and a down file.
+'-template-dir' makes create render new files from the text/template files
+<driver>.up.tmpl and <driver>.down.tmpl of the directory, or else up.tmpl and
+down.tmpl. See migrate.TemplateData for the available data, plus {{env "VAR"}}.
+'-sequential' makes create number migrations 0001, 0002... instead of using the
+current time, zero-padded to '-digits' (4 by default).
+'-var' sets the value of the ${NAME} placeholders of migration files, and can
+be repeated. '-env-vars' takes the values of the other placeholders from the
+environment. Undefined placeholders are an error, $${NAME} is left as ${NAME}.
+'-secret' masks the value of a variable in the output, and can be repeated.
 `)
 }
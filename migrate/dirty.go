@@ -0,0 +1,58 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/file"
+)
+
+// DirtyError is returned by runs refusing to migrate a database
+// where some migrations started but didn't complete.
+type DirtyError struct {
+	Versions file.Versions
+}
+
+func (e *DirtyError) Error() string {
+	return fmt.Sprintf("Database is dirty: migration of versions %s didn't complete. Fix the database by hand, then clear the dirty state.", joinVersions(e.Versions))
+}
+
+// Dirty returns the versions whose migration started but didn't
+// complete. Drivers not implementing driver.DirtyTracker are never dirty.
+func (m *Migrator) Dirty(ctx context.Context) (file.Versions, error) {
+	if err := ctx.Err(); err != nil {
+		return file.Versions{}, err
+	}
+	t, ok := m.driver.(driver.DirtyTracker)
+	if !ok {
+		return file.Versions{}, nil
+	}
+	return t.Dirty()
+}
+
+// ClearDirty removes the dirty flag of version once the database has
+// been fixed by hand. If applied is true, version stays applied,
+// otherwise it becomes pending again.
+func (m *Migrator) ClearDirty(ctx context.Context, version file.Version, applied bool) error {
+	dirty, err := m.Dirty(ctx)
+	if err != nil {
+		return err
+	}
+	if !dirty.Contains(version) {
+		return fmt.Errorf("Version %d is not dirty", version)
+	}
+	return m.driver.(driver.DirtyTracker).ClearDirty(version, applied)
+}
+
+// checkDirty returns a *DirtyError if the database is dirty.
+func (m *Migrator) checkDirty(ctx context.Context) error {
+	dirty, err := m.Dirty(ctx)
+	if err != nil {
+		return err
+	}
+	if len(dirty) > 0 {
+		return &DirtyError{Versions: dirty}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/file"
+)
+
+var (
+	funcsMu sync.Mutex
+	// funcs holds the Go migrations registered with RegisterFunc,
+	// by driver name
+	funcs = map[string]file.MigrationFiles{}
+)
+
+// RegisterFunc registers Go functions as the up and down migrations of
+// version, for the Migrators of the driver registered as driverName, such
+// as "postgres": a binary can run Migrators of drivers unable to run Go
+// migrations, like cassandra or bash. Either function can be nil. It's
+// meant to be called from init functions, and panics if version is
+// registered twice for the driver. Go migrations are run along with the
+// migration files of the same driver, in version order.
+func RegisterFunc(driverName string, version file.Version, name string, up, down file.Func) {
+	funcsMu.Lock()
+	defer funcsMu.Unlock()
+	funcs[driverName] = registerFunc(funcs[driverName], version, name, up, down)
+}
+
+// RegisterFunc is like the RegisterFunc function, but registers
+// the migration for m only.
+func (m *Migrator) RegisterFunc(version file.Version, name string, up, down file.Func) {
+	m.funcs = registerFunc(m.funcs, version, name, up, down)
+}
+
+func registerFunc(registered file.MigrationFiles, version file.Version, name string, up, down file.Func) file.MigrationFiles {
+	if up == nil && down == nil {
+		panic(fmt.Sprintf("RegisterFunc: no function for version %d", version))
+	}
+	for _, mf := range registered {
+		if mf.Version == version {
+			panic(fmt.Sprintf("RegisterFunc: version %d registered twice", version))
+		}
+	}
+	return append(registered, file.NewFuncMigration(version, name, up, down))
+}
+
+// readMigrationFiles reads the migration files of the source,
+// merged with the registered Go migrations.
+func (m *Migrator) readMigrationFiles() (file.MigrationFiles, error) {
+	files, err := file.ReadSourceMigrationFiles(m.source, file.FilenameRegex(m.driver.FilenameExtension()))
+	if err != nil {
+		return nil, err
+	}
+	funcsMu.Lock()
+	registered := append(file.MigrationFiles{}, funcs[driver.Name(m.driver)]...)
+	funcsMu.Unlock()
+	return files.Merge(append(registered, m.funcs...)...)
+}
@@ -3,16 +3,17 @@
 package migrate
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"os"
-	"os/signal"
 	"path"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/event"
 	"github.com/gemnasium/migrate/file"
 	"github.com/gemnasium/migrate/migrate/direction"
 	pipep "github.com/gemnasium/migrate/pipe"
@@ -20,37 +21,9 @@ import (
 
 // Up applies all available migrations.
 func Up(pipe chan interface{}, url, migrationsPath string) {
-	d, files, versions, err := initDriverAndReadMigrationFilesAndGetVersions(url, migrationsPath)
-	defer func() {
-		if err != nil {
-			pipe <- err
-
-		}
-		if d != nil {
-			if err = d.Close(); err != nil {
-				pipe <- err
-			}
-		}
-		go pipep.Close(pipe, nil)
-	}()
-	if err != nil {
-		return
-	}
-
-	applyMigrationFiles, err := files.Pending(versions)
-	if err != nil {
-		return
-	}
-
-	if len(applyMigrationFiles) > 0 {
-		for _, f := range applyMigrationFiles {
-			pipe1 := pipep.New()
-			go d.Migrate(f, pipe1)
-			if ok := pipep.WaitAndRedirect(pipe1, pipe, handleInterrupts()); !ok {
-				break
-			}
-		}
-	}
+	runWithPipe(pipe, url, migrationsPath, func(m *Migrator) (*Result, error) {
+		return m.Up(context.Background())
+	})
 }
 
 // UpSync is synchronous version of Up().
@@ -63,37 +36,9 @@ func UpSync(url, migrationsPath string) (err []error, ok bool) {
 
 // Down rolls back all migrations.
 func Down(pipe chan interface{}, url, migrationsPath string) {
-	d, files, versions, err := initDriverAndReadMigrationFilesAndGetVersions(url, migrationsPath)
-	defer func() {
-		if err != nil {
-			pipe <- err
-
-		}
-		if d != nil {
-			if err = d.Close(); err != nil {
-				pipe <- err
-			}
-		}
-		go pipep.Close(pipe, nil)
-	}()
-	if err != nil {
-		return
-	}
-
-	applyMigrationFiles, err := files.Applied(versions)
-	if err != nil {
-		return
-	}
-
-	if len(applyMigrationFiles) > 0 {
-		for _, f := range applyMigrationFiles {
-			pipe1 := pipep.New()
-			go d.Migrate(f, pipe1)
-			if ok := pipep.WaitAndRedirect(pipe1, pipe, handleInterrupts()); !ok {
-				break
-			}
-		}
-	}
+	runWithPipe(pipe, url, migrationsPath, func(m *Migrator) (*Result, error) {
+		return m.Down(context.Background())
+	})
 }
 
 // DownSync is synchronous version of Down().
@@ -106,13 +51,9 @@ func DownSync(url, migrationsPath string) (err []error, ok bool) {
 
 // Redo rolls back the most recently applied migration, then runs it again.
 func Redo(pipe chan interface{}, url, migrationsPath string) {
-	pipe1 := pipep.New()
-	go Migrate(pipe1, url, migrationsPath, -1)
-	if ok := pipep.WaitAndRedirect(pipe1, pipe, handleInterrupts()); !ok {
-		go pipep.Close(pipe, nil)
-		return
-	}
-	go Migrate(pipe, url, migrationsPath, +1)
+	runWithPipe(pipe, url, migrationsPath, func(m *Migrator) (*Result, error) {
+		return m.Redo(context.Background())
+	})
 }
 
 // RedoSync is synchronous version of Redo().
@@ -125,13 +66,9 @@ func RedoSync(url, migrationsPath string) (err []error, ok bool) {
 
 // Reset runs the down and up migration function.
 func Reset(pipe chan interface{}, url, migrationsPath string) {
-	pipe1 := pipep.New()
-	go Down(pipe1, url, migrationsPath)
-	if ok := pipep.WaitAndRedirect(pipe1, pipe, handleInterrupts()); !ok {
-		go pipep.Close(pipe, nil)
-		return
-	}
-	go Up(pipe, url, migrationsPath)
+	runWithPipe(pipe, url, migrationsPath, func(m *Migrator) (*Result, error) {
+		return m.Reset(context.Background())
+	})
 }
 
 // ResetSync is synchronous version of Reset().
@@ -144,36 +81,9 @@ func ResetSync(url, migrationsPath string) (err []error, ok bool) {
 
 // Migrate applies relative +n/-n migrations.
 func Migrate(pipe chan interface{}, url, migrationsPath string, relativeN int) {
-	d, files, versions, err := initDriverAndReadMigrationFilesAndGetVersions(url, migrationsPath)
-	defer func() {
-		if err != nil {
-			pipe <- err
-		}
-		if d != nil {
-			if err = d.Close(); err != nil {
-				pipe <- err
-			}
-		}
-		go pipep.Close(pipe, nil)
-	}()
-	if err != nil {
-		return
-	}
-
-	applyMigrationFiles, err := files.Relative(relativeN, versions)
-	if err != nil {
-		return
-	}
-
-	if len(applyMigrationFiles) > 0 && relativeN != 0 {
-		for _, f := range applyMigrationFiles {
-			pipe1 := pipep.New()
-			go d.Migrate(f, pipe1)
-			if ok := pipep.WaitAndRedirect(pipe1, pipe, handleInterrupts()); !ok {
-				break
-			}
-		}
-	}
+	runWithPipe(pipe, url, migrationsPath, func(m *Migrator) (*Result, error) {
+		return m.Migrate(context.Background(), relativeN)
+	})
 }
 
 // MigrateSync is synchronous version of Migrate().
@@ -184,12 +94,28 @@ func MigrateSync(url, migrationsPath string, relativeN int) (err []error, ok boo
 	return err, len(err) == 0
 }
 
+// Goto migrates up or down to land exactly on version.
+func Goto(pipe chan interface{}, url, migrationsPath string, version file.Version) {
+	runWithPipe(pipe, url, migrationsPath, func(m *Migrator) (*Result, error) {
+		return m.Goto(context.Background(), version)
+	})
+}
+
+// GotoSync is synchronous version of Goto().
+func GotoSync(url, migrationsPath string, version file.Version) (err []error, ok bool) {
+	pipe := pipep.New()
+	go Goto(pipe, url, migrationsPath, version)
+	err = pipep.ReadErrors(pipe)
+	return err, len(err) == 0
+}
+
 // Version returns the current migration version.
 func Version(url, migrationsPath string) (version file.Version, err error) {
 	d, err := driver.New(url)
 	if err != nil {
 		return 0, err
 	}
+	defer d.Close()
 	return d.Version()
 }
 
@@ -199,21 +125,88 @@ func Versions(url, migrationsPath string) (versions file.Versions, err error) {
 	if err != nil {
 		return file.Versions{}, err
 	}
+	defer d.Close()
 	return d.Versions()
 }
 
+// Verify compares applied migrations with the migration files.
+func Verify(url, migrationsPath string) (*Drift, error) {
+	d, err := driver.New(url)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return NewMigrator(d, migrationsPath).Verify(context.Background())
+}
+
+// Status lists every migration and its state, oldest first.
+func Status(url, migrationsPath string) ([]MigrationStatus, error) {
+	d, err := driver.New(url)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return NewMigrator(d, migrationsPath).Status(context.Background())
+}
+
+// Dirty returns the versions whose migration didn't complete.
+func Dirty(url, migrationsPath string) (file.Versions, error) {
+	d, err := driver.New(url)
+	if err != nil {
+		return file.Versions{}, err
+	}
+	defer d.Close()
+	return NewMigrator(d, migrationsPath).Dirty(context.Background())
+}
+
+// ClearDirty removes the dirty flag of version, keeping it applied
+// if applied is true.
+func ClearDirty(url, migrationsPath string, version file.Version, applied bool) error {
+	d, err := driver.New(url)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return NewMigrator(d, migrationsPath).ClearDirty(context.Background(), version, applied)
+}
+
 // Create creates new migration files on disk.
 func Create(url, migrationsPath, name string) (*file.MigrationFile, error) {
-	d, files, _, err := initDriverAndReadMigrationFilesAndGetVersions(url, migrationsPath)
+	d, err := driver.New(url)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return NewMigrator(d, migrationsPath).Create(name)
+}
+
+// Create creates new migration files in the migrations path, or a single
+// file with up and down sections if m.SingleFile is set. Their content
+// is rendered from the templates of m.TemplateDir, if set. The version is
+// the current UTC time, or the next number if m.Sequential is set. A warning
+// is emitted if the migrations path already holds versions of the other kind.
+// The Migrator must read its files from a file.Dir.
+func (m *Migrator) Create(name string) (*file.MigrationFile, error) {
+	dir, ok := m.source.(file.Dir)
+	if !ok {
+		return nil, errors.New("migration files can only be created in a directory")
+	}
+	files, err := m.readMigrationFiles()
 	if err != nil {
 		return nil, err
 	}
 
-	versionStr := time.Now().UTC().Format("20060102150405")
+	now := time.Now().UTC()
+	versionStr := now.Format("20060102150405")
 	v, _ := strconv.ParseUint(versionStr, 10, 64)
 	version := file.Version(v)
+	digits := 0
+	if m.Sequential {
+		version = 1
+		digits = m.SequenceDigits
+	}
 
-	filenamef := "%d_%s.%s.%s"
+	filenamef := "%0*d_%s.%s.%s"
 	name = strings.Replace(name, " ", "_", -1)
 
 	// if latest version has the same timestamp, increment version
@@ -223,25 +216,49 @@ func Create(url, migrationsPath, name string) (*file.MigrationFile, error) {
 			version = latest + 1
 		}
 	}
+	if mixedVersions(files, m.Sequential) {
+		m.emit(event.Event{Kind: event.Warning, Message: "Migrations path mixes timestamp and sequential versions, they might not be applied in the intended order"})
+	}
 
 	mfile := &file.MigrationFile{
 		Version: version,
 		UpFile: &file.File{
-			Path:      migrationsPath,
-			FileName:  fmt.Sprintf(filenamef, version, name, "up", d.FilenameExtension()),
+			Path:      string(dir),
+			FileName:  fmt.Sprintf(filenamef, digits, version, name, "up", m.driver.FilenameExtension()),
+			Version:   version,
 			Name:      name,
 			Content:   []byte(""),
 			Direction: direction.Up,
 		},
 		DownFile: &file.File{
-			Path:      migrationsPath,
-			FileName:  fmt.Sprintf(filenamef, version, name, "down", d.FilenameExtension()),
+			Path:      string(dir),
+			FileName:  fmt.Sprintf(filenamef, digits, version, name, "down", m.driver.FilenameExtension()),
+			Version:   version,
 			Name:      name,
 			Content:   []byte(""),
 			Direction: direction.Down,
 		},
 	}
 
+	if m.TemplateDir != "" {
+		for _, f := range []*file.File{mfile.UpFile, mfile.DownFile} {
+			if f.Content, err = m.renderTemplate(f, now); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if m.SingleFile {
+		filename := fmt.Sprintf("%0*d_%s.%s", digits, version, name, m.driver.FilenameExtension())
+		mfile.UpFile.FileName = filename
+		mfile.DownFile.FileName = filename
+		content := file.JoinSections(m.driver.FilenameExtension(), mfile.UpFile.Content, mfile.DownFile.Content)
+		if err := ioutil.WriteFile(path.Join(string(dir), filename), content, 0644); err != nil {
+			return nil, err
+		}
+		return mfile, nil
+	}
+
 	if err := ioutil.WriteFile(path.Join(mfile.UpFile.Path, mfile.UpFile.FileName), mfile.UpFile.Content, 0644); err != nil {
 		return nil, err
 	}
@@ -252,27 +269,38 @@ func Create(url, migrationsPath, name string) (*file.MigrationFile, error) {
 	return mfile, nil
 }
 
-// initDriverAndReadMigrationFilesAndGetVersionsAndGetVersion is a small helper
-// function that is common to most of the migration funcs.
-func initDriverAndReadMigrationFilesAndGetVersions(url, migrationsPath string) (driver.Driver, file.MigrationFiles, file.Versions, error) {
-	d, err := driver.New(url)
-	if err != nil {
-		return nil, nil, file.Versions{}, err
+// timestampVersion is the smallest timestamp version, at 1000-01-01 00:00:00.
+const timestampVersion = 10000101000000
+
+// mixedVersions reports whether files hold timestamp versions if
+// sequential is set, or sequential versions otherwise.
+func mixedVersions(files file.MigrationFiles, sequential bool) bool {
+	for _, f := range files {
+		if (f.Version >= timestampVersion) == sequential {
+			return true
+		}
 	}
-	files, err := file.ReadMigrationFiles(migrationsPath, file.FilenameRegex(d.FilenameExtension()))
+	return false
+}
+
+// runWithPipe is a small helper function that is common to the
+// url based migration funcs. It opens the driver, runs fn with a
+// Migrator sending its events to pipe and closes the pipe.
+func runWithPipe(pipe chan interface{}, url, migrationsPath string, fn func(*Migrator) (*Result, error)) {
+	d, err := driver.New(url)
 	if err != nil {
-		d.Close() // TODO what happens with errors from this func?
-		return nil, nil, file.Versions{}, err
+		go pipep.Close(pipe, err)
+		return
 	}
 
-	versions, err := d.Versions()
-	if err != nil {
-		d.Close() // TODO what happens with errors from this func?
-		return nil, nil, file.Versions{}, err
+	m := NewMigrator(d, migrationsPath)
+	m.Sink = event.PipeSink(pipe)
+	fn(m)
 
+	if err := d.Close(); err != nil {
+		pipe <- err
 	}
-
-	return d, files, versions, nil
+	go pipep.Close(pipe, nil)
 }
 
 // NewPipe is a convenience function for pipe.New().
@@ -281,31 +309,14 @@ func NewPipe() chan interface{} {
 	return pipep.New()
 }
 
-// interrupts is an internal variable that holds the state of
-// interrupt handling.
-var interrupts = true
-
-// Graceful enables interrupts checking. Once the first ^C is received
-// it will finish the currently running migration and abort execution
-// of the next migration. If ^C is received twice, it will stop
-// execution immediately.
-func Graceful() {
-	interrupts = true
-}
-
-// NonGraceful disables interrupts checking. The first received ^C will
-// stop execution immediately.
-func NonGraceful() {
-	interrupts = false
-}
-
-// interrupts returns a signal channel if interrupts checking is
-// enabled. nil otherwise.
-func handleInterrupts() chan os.Signal {
-	if interrupts {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		return c
-	}
-	return nil
-}
+// Graceful used to enable interrupts checking.
+//
+// Deprecated: the migrate package doesn't listen for signals anymore.
+// Cancel the context passed to a Migrator to stop a run.
+func Graceful() {}
+
+// NonGraceful used to disable interrupts checking.
+//
+// Deprecated: the migrate package doesn't listen for signals anymore.
+// Cancel the context passed to a Migrator to stop a run.
+func NonGraceful() {}
@@ -1,12 +1,18 @@
 package migrate
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 	// Ensure imports for each driver we wish to test
 
 	"github.com/gemnasium/migrate/driver"
@@ -14,6 +20,7 @@ import (
 	_ "github.com/gemnasium/migrate/driver/mysql"
 	_ "github.com/gemnasium/migrate/driver/postgres"
 	_ "github.com/gemnasium/migrate/driver/sqlite3"
+	"github.com/gemnasium/migrate/event"
 	"github.com/gemnasium/migrate/file"
 	"github.com/gemnasium/migrate/migrate/direction"
 )
@@ -67,6 +74,172 @@ func TestCreate(t *testing.T) {
 	}
 }
 
+func TestCreateSingleFile(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMigrator(d, tmpdir)
+		m.SingleFile = true
+		file1, err := m.Create("single")
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := ioutil.ReadDir(tmpdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0].Name() != file1.UpFile.FileName {
+			t.Fatalf("Expected a single file %s, got %v", file1.UpFile.FileName, files)
+		}
+		content := file.JoinSections(d.FilenameExtension(), []byte("CREATE TABLE single_file (id int PRIMARY KEY);\n"), []byte("DROP TABLE single_file;\n"))
+		if err := ioutil.WriteFile(path.Join(tmpdir, file1.UpFile.FileName), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		r, err := m.Up(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Files) != 1 || r.Files[0].Version != file1.Version {
+			t.Fatalf("Expected version %d to be applied, got %v", file1.Version, r.Files)
+		}
+		// the table must have been dropped by the down section
+		if _, err := m.Redo(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+	}
+}
+
+func TestCreateSequential(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMigrator(d, tmpdir)
+		m.Sequential = true
+		m.SequenceDigits = 4
+		var warnings []string
+		m.Sink = event.SinkFunc(func(e event.Event) {
+			if e.Kind == event.Warning {
+				warnings = append(warnings, e.Message)
+			}
+		})
+
+		for i, expected := range []string{"0001_first.up.", "0002_second.up."} {
+			mfile, err := m.Create([]string{"first", "second"}[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mfile.Version != file.Version(i+1) || !strings.HasPrefix(mfile.UpFile.FileName, expected) {
+				t.Errorf("Expected %s, got version %d in %s", expected, mfile.Version, mfile.UpFile.FileName)
+			}
+		}
+		if len(warnings) != 0 {
+			t.Fatalf("Expected no warning, got %v", warnings)
+		}
+
+		if err := createOldMigrationFile(driverUrl, tmpdir); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Create("third"); err != nil {
+			t.Fatal(err)
+		}
+		if len(warnings) != 1 {
+			t.Fatalf("Expected a warning about mixed versions, got %v", warnings)
+		}
+		m.Sequential = false
+		if _, err := m.Create("fourth"); err != nil {
+			t.Fatal(err)
+		}
+		if len(warnings) != 2 {
+			t.Fatalf("Expected a warning about mixed versions, got %v", warnings)
+		}
+		d.Close()
+	}
+}
+
+func TestCreateTemplates(t *testing.T) {
+	templateDir, err := ioutil.TempDir("/tmp", "migrate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(templateDir)
+	templates := map[string]string{
+		"up.tmpl":   "-- {{.Version}} {{.Name}} {{.Direction}} {{.Driver}} by {{env \"MIGRATE_TEST_AUTHOR\"}}\n",
+		"down.tmpl": "-- generic {{.Direction}}\n",
+	}
+	for _, driverUrl := range driverUrls {
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		templates[driver.Name(d)+".down.tmpl"] = "-- {{.Driver}} {{.Direction}} {{.Timestamp.Year}}\n"
+		d.Close()
+	}
+	for name, content := range templates {
+		if err := ioutil.WriteFile(path.Join(templateDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("MIGRATE_TEST_AUTHOR", "alice")
+	defer os.Unsetenv("MIGRATE_TEST_AUTHOR")
+
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMigrator(d, tmpdir)
+		m.TemplateDir = templateDir
+		file1, err := m.Create("templated")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+
+		name := driver.Name(d)
+		expected := map[string]string{
+			file1.UpFile.FileName:   fmt.Sprintf("-- %d templated up %s by alice\n", file1.Version, name),
+			file1.DownFile.FileName: fmt.Sprintf("-- %s down %d\n", name, time.Now().UTC().Year()),
+		}
+		for filename, content := range expected {
+			written, err := ioutil.ReadFile(path.Join(tmpdir, filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(written) != content {
+				t.Errorf("Expected %s to be %q, got %q", filename, content, written)
+			}
+		}
+	}
+}
+
 func TestReset(t *testing.T) {
 	for _, driverUrl := range driverUrls {
 		t.Logf("Test driver: %s", driverUrl)
@@ -304,36 +477,1125 @@ func TestMigrate(t *testing.T) {
 			t.Errorf("Expected versions to be: %v, got: %v", expectedVersions, versions)
 		}
 
+		if errs, ok := DownSync(driverUrl, tmpdir); !ok {
+			t.Fatal(errs)
+		}
 	}
 }
 
-func createOldMigrationFile(url, migrationsPath string) error {
-	version := file.Version(20060102150405)
-	filenamef := "%d_%s.%s.%s"
-	name := "old"
-	d, err := driver.New(url)
-	if err != nil {
-		return err
+func TestGoto(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		file1, err := Create(driverUrl, tmpdir, "migration1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file2, err := Create(driverUrl, tmpdir, "migration2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file3, err := Create(driverUrl, tmpdir, "migration3")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, v := range []file.Version{file2.Version, file3.Version, file1.Version, 0} {
+			errs, ok := GotoSync(driverUrl, tmpdir, v)
+			if !ok {
+				t.Fatal(errs)
+			}
+			version, err := Version(driverUrl, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != v {
+				t.Fatalf("Expected version %d, got %v", v, version)
+			}
+		}
+
+		if errs, ok := GotoSync(driverUrl, tmpdir, file3.Version+1); ok {
+			t.Fatal("Expected error for unknown version, got", errs)
+		}
 	}
+}
 
-	mfile := &file.MigrationFile{
-		Version: version,
-		UpFile: &file.File{
-			Path:      migrationsPath,
-			FileName:  fmt.Sprintf(filenamef, version, name, "up", d.FilenameExtension()),
-			Name:      name,
-			Content:   []byte(""),
-			Direction: direction.Up,
-		},
-		DownFile: &file.File{
-			Path:      migrationsPath,
-			FileName:  fmt.Sprintf(filenamef, version, name, "down", d.FilenameExtension()),
-			Name:      name,
-			Content:   []byte(""),
-			Direction: direction.Down,
-		},
+func TestMigrator(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMigrator(d, tmpdir)
+		// drivers differ in the other events they send, such as
+		// StatementExecuted
+		kinds := []event.Kind{}
+		m.Sink = event.SinkFunc(func(e event.Event) {
+			switch e.Kind {
+			case event.MigrationStarted, event.MigrationFinished, event.Error, event.Interrupted:
+				kinds = append(kinds, e.Kind)
+			}
+		})
+
+		file1, err := m.Create("migration1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file2, err := m.Create("migration2")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		r, err := m.Up(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Files) != 2 || r.Files[0].Version != file1.Version || r.Files[1].Version != file2.Version {
+			t.Fatalf("Expected files %d and %d to be applied, got %v", file1.Version, file2.Version, r.Files)
+		}
+		expectKinds := []event.Kind{event.MigrationStarted, event.MigrationFinished, event.MigrationStarted, event.MigrationFinished}
+		if !reflect.DeepEqual(kinds, expectKinds) {
+			t.Fatalf("Expected events %v, got %v", expectKinds, kinds)
+		}
+
+		r, err = m.Redo(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Files) != 2 || r.Files[0].Direction != direction.Down || r.Files[1].Direction != direction.Up {
+			t.Fatalf("Expected one down and one up file, got %v", r.Files)
+		}
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		r, err = m.Down(cancelled)
+		if err != context.Canceled {
+			t.Fatalf("Expected %v, got %v", context.Canceled, err)
+		}
+		if !r.Interrupted || len(r.Files) != 0 {
+			t.Fatalf("Expected interrupted run without files, got %+v", r)
+		}
+		if last := kinds[len(kinds)-1]; last != event.Interrupted {
+			t.Fatalf("Expected last event to be %v, got %v", event.Interrupted, last)
+		}
+		version, err := m.Version(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != file2.Version {
+			t.Fatalf("Expected version %d, got %v", file2.Version, version)
+		}
+
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
 	}
+}
 
-	err = ioutil.WriteFile(path.Join(mfile.UpFile.Path, mfile.UpFile.FileName), mfile.UpFile.Content, 0644)
+func TestDryRun(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMigrator(d, tmpdir)
+
+		file1, err := m.Create("migration1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file2, err := m.Create("migration2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(tmpdir, file2.DownFile.FileName), []byte("-- nothing to undo\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		m.DryRun = true
+		r, err := m.Up(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.DryRun || len(r.Files) != 2 {
+			t.Fatalf("Expected a dry run planning 2 files, got %+v", r)
+		}
+		version, err := m.Version(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 0 {
+			t.Fatalf("Expected version 0 after dry run, got %v", version)
+		}
+
+		m.DryRun = false
+		if _, err := m.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		m.DryRun = true
+		var tests = []struct {
+			run    func(context.Context) (*Result, error)
+			expect []*file.File
+		}{
+			{m.Redo, []*file.File{file2.DownFile, file2.UpFile}},
+			{m.Reset, []*file.File{file2.DownFile, file1.DownFile, file1.UpFile, file2.UpFile}},
+			{m.Down, []*file.File{file2.DownFile, file1.DownFile}},
+		}
+		for _, test := range tests {
+			r, err := test.run(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.Files) != len(test.expect) {
+				t.Fatalf("Expected %d planned files, got %v", len(test.expect), r.Files)
+			}
+			for i, f := range test.expect {
+				if r.Files[i].FileName != f.FileName {
+					t.Errorf("Expected planned file %d to be %s, got %s", i, f.FileName, r.Files[i].FileName)
+				}
+			}
+		}
+
+		r, err = m.Redo(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plan1, plan2 bytes.Buffer
+		if err := WritePlan(&plan1, r.Files); err != nil {
+			t.Fatal(err)
+		}
+		if err := WritePlan(&plan2, r.Files); err != nil {
+			t.Fatal(err)
+		}
+		if plan1.String() != plan2.String() {
+			t.Errorf("Expected plans to be identical, got:\n%s\nand:\n%s", plan1.String(), plan2.String())
+		}
+		if !strings.Contains(plan1.String(), "down "+fmt.Sprint(file2.Version)) || !strings.Contains(plan1.String(), "-- nothing to undo") {
+			t.Errorf("Plan is missing the down migration:\n%s", plan1.String())
+		}
+
+		m.DryRun = false
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d1, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d2, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		locker, ok := d1.(driver.Locker)
+		if !ok {
+			t.Fatalf("Driver %T doesn't implement driver.Locker", d1)
+		}
+
+		m := NewMigrator(d2, tmpdir)
+		m.LockTimeout = 100 * time.Millisecond
+		if _, err := m.Create("migration1"); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		if err := locker.Lock(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Up(ctx); err == nil {
+			t.Fatal("Expected Up to fail while another driver holds the lock")
+		}
+		if err := locker.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := m.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		// a killed run leaves the lock of some drivers behind
+		if _, ok := d2.(driver.ForceUnlocker); ok {
+			if err := locker.Lock(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.ForceUnlock(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := m.Up(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := m.Down(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		d1.Close()
+		d2.Close()
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMigrator(d, tmpdir)
+		file1, err := m.Create("migration1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		if _, err := m.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		drift, err := m.Verify(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drift.Detected() || len(drift.Unknown) != 0 {
+			t.Fatalf("Expected no drift, got %+v", drift)
+		}
+
+		upFile := path.Join(tmpdir, file1.UpFile.FileName)
+		if err := ioutil.WriteFile(upFile, []byte("-- edited\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		drift, err = m.Verify(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := file.Versions{file1.Version}
+		if !reflect.DeepEqual(drift.Modified, expected) {
+			t.Fatalf("Expected modified versions %v, got %v", expected, drift.Modified)
+		}
+
+		file2, err := m.Create("migration2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = m.Up(ctx)
+		if _, ok := err.(*Drift); !ok {
+			t.Fatalf("Expected Up to fail with drift, got %v", err)
+		}
+		m.IgnoreDrift = true
+		if _, err := m.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Remove(path.Join(tmpdir, file2.UpFile.FileName)); err != nil {
+			t.Fatal(err)
+		}
+		drift, err = m.Verify(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = file.Versions{file2.Version}
+		if !reflect.DeepEqual(drift.Missing, expected) {
+			t.Fatalf("Expected missing versions %v, got %v", expected, drift.Missing)
+		}
+
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+	}
+}
+
+func TestStatus(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMigrator(d, tmpdir)
+		file1, err := m.Create("migration1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		if _, err := m.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := createOldMigrationFile(driverUrl, tmpdir); err != nil {
+			t.Fatal(err)
+		}
+
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := d.(driver.RecordReader); ok {
+			if statuses[1].AppliedAt == nil {
+				t.Fatalf("Expected version %d to have an applied time", file1.Version)
+			}
+			statuses[1].AppliedAt = nil
+		}
+		expected := []MigrationStatus{
+			{Version: 20060102150405, Name: "old", OutOfOrder: true},
+			{Version: file1.Version, Name: "migration1", Applied: true},
+		}
+		if !reflect.DeepEqual(statuses, expected) {
+			t.Fatalf("Expected statuses %+v, got %+v", expected, statuses)
+		}
+		var buf bytes.Buffer
+		if err := WriteStatus(&buf, statuses); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), "out-of-order") {
+			t.Fatalf("Expected out-of-order flag in:\n%s", buf.String())
+		}
+
+		// hide the files of the applied migration
+		movedDir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range []*file.File{file1.UpFile, file1.DownFile} {
+			if err := os.Rename(path.Join(tmpdir, f.FileName), path.Join(movedDir, f.FileName)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		statuses, err = m.Status(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last := statuses[len(statuses)-1]; !last.Missing {
+			t.Fatalf("Expected version %d to be missing, got %+v", file1.Version, last)
+		}
+		for _, f := range []*file.File{file1.UpFile, file1.DownFile} {
+			if err := os.Rename(path.Join(movedDir, f.FileName), path.Join(tmpdir, f.FileName)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+	}
+}
+
+func TestMigrationsTable(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		separator := "?"
+		if strings.Contains(driverUrl, "?") {
+			separator = "&"
+		}
+		d, err := driver.New(driverUrl + separator + driver.TableParam + "=other_migrations")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMigrator(d, tmpdir)
+		file1, err := m.Create("migration1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		if _, err := m.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		versions, err := Versions(driverUrl, tmpdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if versions.Contains(file1.Version) {
+			t.Fatalf("Expected version %d to be recorded in other_migrations only", file1.Version)
+		}
+		versions, err = m.Versions(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !versions.Contains(file1.Version) {
+			t.Fatalf("Expected version %d to be recorded in other_migrations", file1.Version)
+		}
+
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+	}
+}
+
+// dirtyDriver reports a fixed set of dirty versions.
+type dirtyDriver struct {
+	driver.Driver
+	dirty file.Versions
+}
+
+func (d *dirtyDriver) Dirty() (file.Versions, error) {
+	return d.dirty, nil
+}
+
+func (d *dirtyDriver) ClearDirty(version file.Version, applied bool) error {
+	d.dirty = file.Versions{}
+	return nil
+}
+
+func TestDirty(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirty := &dirtyDriver{Driver: d, dirty: file.Versions{42}}
+		m := NewMigrator(dirty, tmpdir)
+		if _, err := m.Create("migration1"); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		r, err := m.Up(ctx)
+		if _, ok := err.(*DirtyError); !ok {
+			t.Fatalf("Expected Up to fail with a dirty error, got %v", err)
+		}
+		if len(r.Files) != 0 {
+			t.Fatalf("Expected no migration to run, got %v", r.Files)
+		}
+
+		if err := m.ClearDirty(ctx, 1, true); err == nil {
+			t.Fatal("Expected clearing a version which isn't dirty to fail")
+		}
+		if err := m.ClearDirty(ctx, 42, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+	}
+}
+
+func TestFuncMigration(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		if strings.HasPrefix(driverUrl, "cassandra") {
+			continue // no Go migrations
+		}
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMigrator(d, tmpdir)
+		file1, err := m.Create("migration1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		funcVersion := file1.Version + 1
+		m.RegisterFunc(funcVersion, "func_migration",
+			func(ctx context.Context, tx file.Tx) error {
+				_, err := tx.ExecContext(ctx, "CREATE TABLE func_migration (id INTEGER)")
+				return err
+			},
+			func(ctx context.Context, tx file.Tx) error {
+				_, err := tx.ExecContext(ctx, "DROP TABLE func_migration")
+				return err
+			},
+		)
+
+		ctx := context.Background()
+		r, err := m.Up(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Files) != 2 || r.Files[1].Version != funcVersion {
+			t.Fatalf("Expected the Go migration to run last, got %v", r.Files)
+		}
+		if version, _ := m.Version(ctx); version != funcVersion {
+			t.Fatalf("Expected version %d, got %d", funcVersion, version)
+		}
+
+		r, err = m.Migrate(ctx, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Files) != 1 || r.Files[0].Func == nil {
+			t.Fatalf("Expected the Go migration to be rolled back, got %v", r.Files)
+		}
+
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	noop := func(ctx context.Context, tx file.Tx) error { return nil }
+	for _, driverUrl := range driverUrls {
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := driver.Name(d)
+		other := "other-" + name
+		RegisterFunc(name, 1, "registered", noop, nil)
+		RegisterFunc(other, 2, "other_driver", noop, nil)
+
+		files, err := NewMigrator(d, tmpdir).readMigrationFiles()
+		funcsMu.Lock()
+		delete(funcs, name)
+		delete(funcs, other)
+		funcsMu.Unlock()
+		d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0].Version != 1 {
+			t.Errorf("Expected only the Go migration registered for %s, got %v", name, files)
+		}
+	}
+}
+
+func TestSourceMigrator(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ext := d.FilenameExtension()
+		fsys := fstest.MapFS{
+			"migrations/20060102150405_fs.up." + ext:   {Data: []byte("CREATE TABLE fs_migration (id int PRIMARY KEY);")},
+			"migrations/20060102150405_fs.down." + ext: {Data: []byte("DROP TABLE fs_migration;")},
+		}
+		m := NewSourceMigrator(d, file.FS(fsys, "migrations"))
+
+		ctx := context.Background()
+		r, err := m.Up(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Files) != 1 || r.Files[0].Version != 20060102150405 {
+			t.Fatalf("Expected the embedded migration to run, got %v", r.Files)
+		}
+		if _, err := m.Create("migration1"); err == nil {
+			t.Fatal("Expected Create to fail without a directory")
+		}
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+	}
+}
+
+func TestVars(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMigrator(d, tmpdir)
+		file1, err := m.Create("vars")
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents := map[string]string{
+			file1.UpFile.FileName:   "CREATE TABLE ${TABLE} (id int PRIMARY KEY, note varchar(20) DEFAULT '${PASSWORD}');",
+			file1.DownFile.FileName: "DROP TABLE ${TABLE};",
+		}
+		for filename, content := range contents {
+			if err := ioutil.WriteFile(path.Join(tmpdir, filename), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ctx := context.Background()
+		m.Vars = map[string]string{"TABLE": "vars_test"}
+		if _, err := m.Up(ctx); err == nil || !strings.Contains(err.Error(), "PASSWORD") {
+			t.Fatalf("Expected an undefined variable error, got %v", err)
+		}
+
+		os.Setenv("PASSWORD", "s3cret")
+		defer os.Unsetenv("PASSWORD")
+		m.EnvVars = true
+		m.SecretVars = []string{"PASSWORD"}
+		var output bytes.Buffer
+		m.Sink = event.SinkFunc(func(e event.Event) {
+			fmt.Fprintln(&output, e.Statement, e.Message, e.Err)
+			if e.File != nil {
+				output.Write(e.File.Content)
+			}
+		})
+		m.DryRun = true
+		r, err := m.Up(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan := string(r.Files[0].Content); !strings.Contains(plan, "vars_test") || !strings.Contains(plan, "'****'") {
+			t.Errorf("Expected variables in the plan, with the secret masked, got %q", plan)
+		}
+		m.DryRun = false
+		if _, err := m.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(output.String(), "s3cret") {
+			t.Errorf("Expected the secret to be masked, got %q", output.String())
+		}
+		drift, err := m.Verify(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drift.Detected() {
+			t.Errorf("Expected variables not to change checksums, got %v", drift)
+		}
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		file2, err := m.Create("secret_error")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(tmpdir, file2.UpFile.FileName), []byte("SELECT * FROM missing_${PASSWORD};"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		r, err = m.Up(ctx)
+		if err == nil {
+			t.Fatal("Expected a missing table error")
+		}
+		var migrationErr *driver.MigrationError
+		if !errors.As(err, &migrationErr) || migrationErr.FileName != file2.UpFile.FileName {
+			t.Errorf("Expected a *driver.MigrationError for %s, got %#v", file2.UpFile.FileName, err)
+		}
+		for _, err := range r.Errors {
+			if strings.Contains(err.Error(), "s3cret") {
+				t.Errorf("Expected the secret to be masked in errors, got %q", err.Error())
+			}
+		}
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMigrator(d, tmpdir)
+		if _, err := m.Create("valid"); err != nil {
+			t.Fatal(err)
+		}
+		file2, err := m.Create("invalid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(tmpdir, file2.UpFile.FileName), []byte("-- migrate:unknown\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		r, err := m.Up(ctx)
+		if err == nil || !strings.Contains(err.Error(), "unknown directive") {
+			t.Fatalf("Expected an unknown directive error, got %v", err)
+		}
+		if len(r.Files) != 0 {
+			t.Fatalf("Expected no migration to run, got %v", r.Files)
+		}
+		d.Close()
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		if strings.HasPrefix(driverUrl, "cassandra") {
+			continue // no Go migrations
+		}
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMigrator(d, tmpdir)
+		m.Timeout = 50 * time.Millisecond
+		block := func(ctx context.Context, tx file.Tx) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		m.RegisterFunc(1, "blocking", block, block)
+
+		ctx := context.Background()
+		r, err := m.Up(ctx)
+		if err == nil || !strings.Contains(err.Error(), "timed out after 50ms") {
+			t.Fatalf("Expected a timeout error, got %v", err)
+		}
+		if r.Interrupted || len(r.Files) != 0 {
+			t.Fatalf("Expected the migration to fail without interrupting the run, got %+v", r)
+		}
+		if version, _ := m.Version(ctx); version != 0 {
+			t.Fatalf("Expected version 0, got %d", version)
+		}
+		d.Close()
+	}
+
+	m := &Migrator{Timeout: time.Minute}
+	if timeout := m.timeout(file.File{Content: []byte("-- migrate:timeout=5s\nSELECT 1;")}); timeout != 5*time.Second {
+		t.Errorf("Expected the directive timeout, got %v", timeout)
+	}
+	if timeout := m.timeout(file.File{Content: []byte("SELECT 1;")}); timeout != time.Minute {
+		t.Errorf("Expected the global timeout, got %v", timeout)
+	}
+}
+
+// retryDriver runs migrations in transactions, and classifies
+// errTransient as transient.
+type retryDriver struct {
+	driver.Driver
+}
+
+var errTransient = errors.New("transient error")
+
+func (d *retryDriver) Retryable(err error) bool {
+	return errors.Is(err, errTransient)
+}
+
+func (d *retryDriver) InTransaction(f file.File) bool {
+	return true
+}
+
+func TestRetry(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		if strings.HasPrefix(driverUrl, "cassandra") || strings.HasPrefix(driverUrl, "mysql") {
+			continue // no Go migrations, or versions marked dirty outside of the transaction
+		}
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMigrator(&retryDriver{d}, tmpdir)
+		m.Retry = RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+		runs, downRuns := 0, 0
+		m.RegisterFunc(1, "flaky",
+			func(ctx context.Context, tx file.Tx) error {
+				runs++
+				if runs < 3 {
+					return errTransient
+				}
+				return nil
+			},
+			func(ctx context.Context, tx file.Tx) error {
+				downRuns++
+				if downRuns == 1 {
+					return errors.New("permanent error")
+				}
+				return nil
+			},
+		)
+		var kinds []event.Kind
+		m.Sink = event.SinkFunc(func(e event.Event) {
+			kinds = append(kinds, e.Kind)
+		})
+
+		ctx := context.Background()
+		r, err := m.Up(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runs != 3 || len(r.Files) != 1 {
+			t.Fatalf("Expected the migration to succeed on the third run, got %d runs and %v", runs, r.Files)
+		}
+		warnings := 0
+		for _, kind := range kinds {
+			if kind == event.Error {
+				t.Fatal("Expected retried errors to be reported as warnings")
+			}
+			if kind == event.Warning {
+				warnings++
+			}
+		}
+		if warnings != 2 {
+			t.Fatalf("Expected 2 warnings, got %d", warnings)
+		}
+
+		if _, err := m.Down(ctx); err == nil || !strings.HasSuffix(err.Error(), "permanent error") || downRuns != 1 {
+			t.Fatalf("Expected the permanent error not to be retried, got %v after %d runs", err, downRuns)
+		}
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+	}
+
+	p := RetryPolicy{Backoff: time.Second, MaxBackoff: 3 * time.Second}
+	for n, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 3 * time.Second, 10: 3 * time.Second} {
+		if wait := p.wait(n); wait != expected {
+			t.Errorf("Expected retry %d to wait %v, got %v", n, expected, wait)
+		}
+	}
+	p.Jitter = 0.5
+	if wait := p.wait(1); wait < 500*time.Millisecond || wait > 1500*time.Millisecond {
+		t.Errorf("Expected the wait to be within the jitter, got %v", wait)
+	}
+}
+
+// flakyDriver fails the first migration it runs after the driver
+// flagged its version as dirty, as a deadlock would.
+type flakyDriver struct {
+	driver.Driver
+	failed bool
+}
+
+func (d *flakyDriver) Migrate(f file.File, pipe chan interface{}) {
+	if !d.failed {
+		d.failed = true
+		f.Content = []byte("-- migrate:no-transaction\nSELECT * FROM missing_table;")
+	}
+	d.Driver.Migrate(f, pipe)
+}
+
+func (d *flakyDriver) Retryable(err error) bool {
+	return true
+}
+
+func TestRetryDirty(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(tmpdir, "1_retried.up.sql"), []byte("-- migrate:no-transaction retries=1\nCREATE TABLE retried (id int);"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(tmpdir, "1_retried.down.sql"), []byte("DROP TABLE retried;"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the retry runs on the version the failed run left behind:
+		// flakyDriver doesn't let the Migrator clear its dirty flag
+		m := NewMigrator(&flakyDriver{Driver: d}, tmpdir)
+		m.Retry = RetryPolicy{Backoff: time.Millisecond}
+
+		ctx := context.Background()
+		r, err := m.Up(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Files) != 1 {
+			t.Fatalf("Expected the migration to succeed when retried, got %v", r.Files)
+		}
+		if dirty, err := d.(driver.DirtyTracker).Dirty(); err != nil || len(dirty) != 0 {
+			t.Fatalf("Expected no dirty version, got %v, %v", dirty, err)
+		}
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+	}
+}
+
+func TestTransactionMode(t *testing.T) {
+	for _, driverUrl := range driverUrls {
+		t.Logf("Test driver: %s", driverUrl)
+		tmpdir, err := ioutil.TempDir("/tmp", "migrate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := driver.New(driverUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMigrator(d, tmpdir)
+		m.TransactionMode = TxAll
+		if _, ok := d.(driver.TxMigrator); !ok {
+			if _, err := m.Up(context.Background()); err == nil || !strings.Contains(err.Error(), "doesn't support") {
+				t.Fatalf("Expected an unsupported transaction mode error, got %v", err)
+			}
+			d.Close()
+			continue
+		}
+
+		write := func(name, content string) {
+			if err := ioutil.WriteFile(path.Join(tmpdir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		write("1_table.up.sql", "CREATE TABLE tx_mode (id INTEGER);")
+		write("1_table.down.sql", "DROP TABLE tx_mode;")
+		write("2_insert.up.sql", "INSERT INTO missing_table VALUES (1);")
+		write("2_insert.down.sql", "DELETE FROM tx_mode;")
+
+		ctx := context.Background()
+		r, err := m.Up(ctx)
+		if err == nil {
+			t.Fatal("Expected the second migration to fail")
+		}
+		if len(r.Files) != 0 {
+			t.Fatalf("Expected the first migration to be rolled back, got %v", r.Files)
+		}
+		if version, err := m.Version(ctx); err != nil || version != 0 {
+			t.Fatalf("Expected version 0, got %d, %v", version, err)
+		}
+
+		// the table of the first migration was rolled back too
+		write("2_insert.up.sql", "INSERT INTO tx_mode VALUES (1);")
+		if r, err := m.Up(ctx); err != nil || len(r.Files) != 2 {
+			t.Fatalf("Expected both migrations to be applied, got %v, %v", r.Files, err)
+		}
+
+		write("3_index.up.sql", "-- migrate:no-transaction\nCREATE INDEX tx_mode_id ON tx_mode (id);")
+		write("3_index.down.sql", "DROP INDEX tx_mode_id;")
+		r, err = m.Up(ctx)
+		if err == nil || !strings.Contains(err.Error(), "no-transaction directive") || len(r.Files) != 0 {
+			t.Fatalf("Expected the no-transaction migration to be rejected, got %v, %v", r.Files, err)
+		}
+
+		m.TransactionMode = TxNone
+		if r, err := m.Up(ctx); err != nil || len(r.Files) != 1 {
+			t.Fatalf("Expected the no-transaction migration to be applied, got %v, %v", r.Files, err)
+		}
+
+		m.TransactionMode = TxAll
+		if _, err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		m.TransactionMode = "nested"
+		if _, err := m.Up(ctx); err == nil || !strings.Contains(err.Error(), "Unknown transaction mode") {
+			t.Fatalf("Expected an unknown transaction mode error, got %v", err)
+		}
+		d.Close()
+	}
+}
+
+func createOldMigrationFile(url, migrationsPath string) error {
+	version := file.Version(20060102150405)
+	filenamef := "%d_%s.%s.%s"
+	name := "old"
+	d, err := driver.New(url)
+	if err != nil {
+		return err
+	}
+
+	mfile := &file.MigrationFile{
+		Version: version,
+		UpFile: &file.File{
+			Path:      migrationsPath,
+			FileName:  fmt.Sprintf(filenamef, version, name, "up", d.FilenameExtension()),
+			Name:      name,
+			Content:   []byte(""),
+			Direction: direction.Up,
+		},
+		DownFile: &file.File{
+			Path:      migrationsPath,
+			FileName:  fmt.Sprintf(filenamef, version, name, "down", d.FilenameExtension()),
+			Name:      name,
+			Content:   []byte(""),
+			Direction: direction.Down,
+		},
+	}
+
+	err = ioutil.WriteFile(path.Join(mfile.UpFile.Path, mfile.UpFile.FileName), mfile.UpFile.Content, 0644)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(mfile.DownFile.Path, mfile.DownFile.FileName), mfile.DownFile.Content, 0644)
 	return err
 }
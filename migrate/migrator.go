@@ -0,0 +1,483 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/event"
+	"github.com/gemnasium/migrate/file"
+	"github.com/gemnasium/migrate/migrate/direction"
+	pipep "github.com/gemnasium/migrate/pipe"
+)
+
+// Migrator runs migrations found in a migration source against a driver.
+// It is built once and can be reused for any number of runs.
+// The Migrator doesn't own the driver: closing it is up to the caller.
+type Migrator struct {
+	driver driver.Driver
+	source file.Source
+
+	// Sink, if not nil, receives the events of every run.
+	// Use event.PipeSink to get them on a pipe.
+	Sink event.Sink
+
+	// DryRun makes runs plan the migration files they would apply,
+	// with their content, without handing them over to the driver.
+	DryRun bool
+
+	// LockTimeout limits the time spent waiting for the migration lock
+	// of drivers implementing driver.Locker. Zero means no limit.
+	LockTimeout time.Duration
+
+	// Timeout limits the time each migration file can run, unless the
+	// file sets its own with a migrate:timeout directive. Once it expires,
+	// the running statement is cancelled and the migration rolled back
+	// where the driver can. Zero means no limit.
+	Timeout time.Duration
+
+	// Retry tells how migration files failing with a transient error,
+	// such as a deadlock, are run again. No file is by default, unless
+	// it has a migrate:retries directive.
+	Retry RetryPolicy
+
+	// TransactionMode tells which transactions migration files are
+	// applied in: their own, the single transaction of the run, or none.
+	// The default, TxPerFile, leaves it up to the driver.
+	TransactionMode TransactionMode
+
+	// IgnoreDrift lets Up apply pending migrations even though
+	// applied migrations were modified or are missing. See Verify.
+	IgnoreDrift bool
+
+	// SingleFile makes Create write a single migration file with
+	// "-- +migrate Up" and "-- +migrate Down" sections.
+	SingleFile bool
+
+	// Sequential makes Create number migrations 1, 2, 3... instead of
+	// using the current time, zero-padded to SequenceDigits digits.
+	Sequential     bool
+	SequenceDigits int
+
+	// TemplateDir is the directory of the text/template files Create
+	// renders new migration files from, see TemplateData.
+	TemplateDir string
+
+	// Vars, if not nil, holds the values of the ${NAME} placeholders of
+	// migration files, substituted before the files are run. Placeholders
+	// without value fail the run. $${NAME} is left as ${NAME}.
+	Vars map[string]string
+
+	// EnvVars makes placeholders without value in Vars take the value
+	// of the environment variable of the same name. It enables the
+	// substitution of placeholders even if Vars is nil.
+	EnvVars bool
+
+	// SecretVars are the names of the variables whose values are masked
+	// in events, the errors of Results and dry run plans.
+	SecretVars []string
+
+	// funcs holds the Go migrations registered with m.RegisterFunc
+	funcs file.MigrationFiles
+}
+
+// Result is the outcome of a migration run.
+type Result struct {
+	// Files holds the migration files that were applied successfully, in order.
+	// For a dry run, it holds the files that would be applied, with their content.
+	Files file.Files
+
+	// Errors holds all errors that occurred during the run.
+	Errors []error
+
+	// Interrupted is true if the run was stopped because its context was done.
+	Interrupted bool
+
+	// DryRun is true if no migration was actually applied.
+	DryRun bool
+}
+
+// err returns the first error of the run, if any.
+func (r *Result) err() error {
+	if len(r.Errors) > 0 {
+		return r.Errors[0]
+	}
+	return nil
+}
+
+// NewMigrator returns a Migrator reading migration files from
+// migrationsPath and applying them with d. migrationsPath is either
+// a directory or an archive, see file.PathSource.
+func NewMigrator(d driver.Driver, migrationsPath string) *Migrator {
+	return NewSourceMigrator(d, file.PathSource(migrationsPath))
+}
+
+// NewSourceMigrator returns a Migrator reading migration files from
+// source, such as file.FS(embedded, "migrations"), and applying them with d.
+func NewSourceMigrator(d driver.Driver, source file.Source) *Migrator {
+	return &Migrator{
+		driver: d,
+		source: source,
+	}
+}
+
+// Driver returns the driver used by the Migrator.
+func (m *Migrator) Driver() driver.Driver {
+	return m.driver
+}
+
+// Up applies all pending migrations.
+// It refuses to run if applied migrations drifted, unless IgnoreDrift is set.
+func (m *Migrator) Up(ctx context.Context) (*Result, error) {
+	return m.run(ctx, m.verified, pending)
+}
+
+// Down rolls back all applied migrations.
+func (m *Migrator) Down(ctx context.Context) (*Result, error) {
+	return m.run(ctx, applied)
+}
+
+// Migrate applies relative +n/-n migrations.
+func (m *Migrator) Migrate(ctx context.Context, relativeN int) (*Result, error) {
+	return m.run(ctx, relative(relativeN))
+}
+
+// Goto migrates up or down to land exactly on version.
+// Version 0 rolls back all migrations, any other version must exist
+// in the migrations path.
+func (m *Migrator) Goto(ctx context.Context, version file.Version) (*Result, error) {
+	return m.run(ctx, func(files file.MigrationFiles, versions file.Versions) (file.Files, error) {
+		return files.Goto(version, versions)
+	})
+}
+
+// Redo rolls back the most recently applied migration, then runs it again.
+func (m *Migrator) Redo(ctx context.Context) (*Result, error) {
+	return m.run(ctx, relative(-1), relative(+1))
+}
+
+// Reset rolls back all migrations, then applies them again.
+func (m *Migrator) Reset(ctx context.Context) (*Result, error) {
+	return m.run(ctx, applied, pending)
+}
+
+// Version returns the current migration version.
+func (m *Migrator) Version(ctx context.Context) (file.Version, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return m.driver.Version()
+}
+
+// Versions returns applied versions.
+func (m *Migrator) Versions(ctx context.Context) (file.Versions, error) {
+	if err := ctx.Err(); err != nil {
+		return file.Versions{}, err
+	}
+	return m.driver.Versions()
+}
+
+// A step picks the migration files to run, given the applied versions.
+type step func(files file.MigrationFiles, versions file.Versions) (file.Files, error)
+
+func pending(files file.MigrationFiles, versions file.Versions) (file.Files, error) {
+	return files.Pending(versions)
+}
+
+func applied(files file.MigrationFiles, versions file.Versions) (file.Files, error) {
+	return files.Applied(versions)
+}
+
+func relative(relativeN int) step {
+	return func(files file.MigrationFiles, versions file.Versions) (file.Files, error) {
+		return files.Relative(relativeN, versions)
+	}
+}
+
+// run reads the migration files and the applied versions, then lets each
+// step pick the files to apply and applies them one after the other.
+// The applied versions are kept up to date between steps, so that a dry
+// run plans the same files a real run would apply.
+// It refuses to start if the database is dirty, and stops at the first
+// failing migration or as soon as ctx is done.
+func (m *Migrator) run(ctx context.Context, steps ...step) (r *Result, err error) {
+	r = &Result{Files: file.Files{}, DryRun: m.DryRun}
+
+	if err := m.checkTransactionMode(); err != nil {
+		m.fail(r, err)
+		return r, err
+	}
+
+	if !m.DryRun {
+		if err := m.lock(ctx); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				m.interrupt(r, ctxErr)
+				return r, ctxErr
+			}
+			m.fail(r, err)
+			return r, err
+		}
+		defer func() {
+			if unlockErr := m.unlock(r); unlockErr != nil && err == nil {
+				err = unlockErr
+			}
+		}()
+	}
+
+	if err := m.checkDirty(ctx); err != nil {
+		m.fail(r, err)
+		return r, err
+	}
+
+	files, err := m.readMigrationFiles()
+	if err != nil {
+		m.fail(r, err)
+		return r, err
+	}
+	versions, err := m.driver.Versions()
+	if err != nil {
+		m.fail(r, err)
+		return r, err
+	}
+
+	var tx *runTx
+	if !m.DryRun {
+		if tx, err = m.beginTx(ctx); err != nil {
+			m.fail(r, err)
+			return r, err
+		}
+		// runs before the lock is released
+		defer func() {
+			err = m.endTx(r, tx, err)
+		}()
+	}
+
+	for _, selectFiles := range steps {
+		applyMigrationFiles, err := selectFiles(files, versions)
+		if err != nil {
+			m.fail(r, err)
+			return r, err
+		}
+		if err := m.prepare(applyMigrationFiles); err != nil {
+			m.fail(r, err)
+			return r, err
+		}
+
+		for _, f := range applyMigrationFiles {
+			if err := ctx.Err(); err != nil {
+				m.interrupt(r, err)
+				return r, err
+			}
+
+			if m.DryRun {
+				if err := f.ReadContent(); err != nil {
+					m.fail(r, err)
+					return r, err
+				}
+				f.Content = []byte(m.mask(string(f.Content)))
+			} else if ok := m.apply(ctx, r, tx, f); !ok {
+				return r, r.err()
+			}
+			r.Files = append(r.Files, f)
+			versions = updateVersions(versions, f)
+		}
+	}
+	return r, nil
+}
+
+// prepare substitutes the variables of files and checks their
+// directives, so that no file runs if one of them is invalid, can't
+// run in the transaction mode of m, or fails the driver's checks.
+func (m *Migrator) prepare(files file.Files) error {
+	for i := range files {
+		if err := m.expand(&files[i]); err != nil {
+			return err
+		}
+		if _, err := files[i].Directives(); err != nil {
+			return err
+		}
+		if err := m.checkTransaction(files[i]); err != nil {
+			return err
+		}
+		if c, ok := m.driver.(driver.Checker); ok {
+			if err := c.Check(files[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// apply runs a single migration file, in tx if not nil, forwarding the
+// driver's events. Files failing with a transient error are run again,
+// see RetryPolicy.
+func (m *Migrator) apply(ctx context.Context, r *Result, tx *runTx, f file.File) (ok bool) {
+	start := time.Now()
+	attempts := m.attempts(f)
+	for attempt := 1; ; attempt++ {
+		errs := m.attempt(ctx, tx, f)
+		if len(errs) == 0 {
+			break
+		}
+		if attempt < attempts && ctx.Err() == nil && m.retryable(errs[0].Err) {
+			wait := m.Retry.wait(attempt)
+			m.emit(event.Event{Kind: event.Warning, File: &f, Err: errs[0].Err,
+				Message: fmt.Sprintf("%s failed, retrying in %v (attempt %d of %d): %v", f.FileName, wait, attempt+1, attempts, errs[0].Err)})
+			err := m.resetDirty(f)
+			if err == nil {
+				select {
+				case <-ctx.Done():
+				case <-time.After(wait):
+					continue
+				}
+			} else {
+				errs = append(errs, event.Event{Kind: event.Error, File: &f, Err: err})
+			}
+		}
+		for _, e := range errs {
+			r.Errors = append(r.Errors, m.maskError(e.Err))
+			m.emit(e)
+		}
+		if err := ctx.Err(); err != nil {
+			m.interrupt(r, nil)
+		}
+		return false
+	}
+	m.emit(event.Event{Kind: event.MigrationFinished, File: &f, Duration: time.Since(start)})
+	return true
+}
+
+// attempt runs f once, forwarding the driver's events but its errors,
+// which are returned.
+func (m *Migrator) attempt(ctx context.Context, tx *runTx, f file.File) (errs []event.Event) {
+	fileCtx := ctx
+	timeout := m.timeout(f)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		fileCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	pipe := pipep.New()
+	go m.migrate(fileCtx, tx, f, pipe)
+	for item := range pipe {
+		e := event.FromPipe(item)
+		if e.Kind != event.Error {
+			m.emit(e)
+			continue
+		}
+		if e.File == nil {
+			e.File = &f
+		}
+		if ctx.Err() == nil && fileCtx.Err() == context.DeadlineExceeded {
+			e.Err = fmt.Errorf("%s timed out after %v: %w", f.FileName, timeout, e.Err)
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// timeout returns the time f can run: the one of its migrate:timeout
+// directive, or else m.Timeout.
+func (m *Migrator) timeout(f file.File) time.Duration {
+	if directives, err := f.Directives(); err == nil && directives.Timeout > 0 {
+		return directives.Timeout
+	}
+	return m.Timeout
+}
+
+// lock takes the driver's migration lock, if it has one.
+func (m *Migrator) lock(ctx context.Context) error {
+	l, ok := m.driver.(driver.Locker)
+	if !ok {
+		return nil
+	}
+	if m.LockTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.LockTimeout)
+		defer cancel()
+	}
+	if err := l.Lock(ctx); err != nil {
+		return fmt.Errorf("Unable to acquire migration lock: %v", err)
+	}
+	return nil
+}
+
+// unlock releases the driver's migration lock, if it has one.
+func (m *Migrator) unlock(r *Result) error {
+	if l, ok := m.driver.(driver.Locker); ok {
+		if err := l.Unlock(); err != nil {
+			m.fail(r, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// ForceUnlock releases the migration lock left behind by a run which
+// was killed, for drivers implementing driver.ForceUnlocker. It must
+// only be called once sure that no other run is in progress. The locks
+// of the other drivers are released when the process holding them dies.
+func (m *Migrator) ForceUnlock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	u, ok := m.driver.(driver.ForceUnlocker)
+	if !ok {
+		return errors.New("The driver's migration lock is released when the run holding it dies, there is nothing to unlock")
+	}
+	return u.ForceUnlock()
+}
+
+// updateVersions returns the applied versions once f has been applied.
+func updateVersions(versions file.Versions, f file.File) file.Versions {
+	updated := make(file.Versions, 0, len(versions)+1)
+	for _, v := range versions {
+		if v != f.Version {
+			updated = append(updated, v)
+		}
+	}
+	if f.Direction == direction.Up {
+		updated = append(updated, f.Version)
+	}
+	return updated
+}
+
+// migrate hands f over to the driver, along with tx if not nil. The context
+// is only passed on if the driver supports it, otherwise the migration
+// can't be stopped half-way.
+func (m *Migrator) migrate(ctx context.Context, tx *runTx, f file.File, pipe chan interface{}) {
+	if tx != nil {
+		tx.migrator.MigrateTx(ctx, tx.tx, f, pipe)
+		return
+	}
+	if d, ok := m.driver.(driver.ContextMigrator); ok {
+		d.MigrateContext(ctx, f, pipe)
+		return
+	}
+	m.driver.Migrate(f, pipe)
+}
+
+// fail records err in r and emits it.
+func (m *Migrator) fail(r *Result, err error) {
+	r.Errors = append(r.Errors, m.maskError(err))
+	m.emit(event.Event{Kind: event.Error, Err: err})
+}
+
+// interrupt marks r as interrupted. err is recorded in r
+// unless the driver already reported why it stopped.
+func (m *Migrator) interrupt(r *Result, err error) {
+	r.Interrupted = true
+	if err != nil {
+		r.Errors = append(r.Errors, m.maskError(err))
+	}
+	m.emit(event.Event{Kind: event.Interrupted, Message: "Migration interrupted.", Err: err})
+}
+
+// emit sends e to the Migrator's sink, if any.
+func (m *Migrator) emit(e event.Event) {
+	if m.Sink != nil {
+		m.Sink.Handle(m.maskEvent(e))
+	}
+}
@@ -0,0 +1,38 @@
+package migrate
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/gemnasium/migrate/file"
+	"github.com/gemnasium/migrate/migrate/direction"
+)
+
+// WritePlan writes the files of a dry run to w, in the order they would
+// be applied, each one preceded by a header with its direction, version
+// and file name. The output only depends on files, so that the same plan
+// always renders the same way.
+func WritePlan(w io.Writer, files file.Files) error {
+	var buf bytes.Buffer
+	if len(files) == 0 {
+		buf.WriteString("-- Nothing to migrate.\n")
+	}
+	for i, f := range files {
+		d := "up"
+		if f.Direction == direction.Down {
+			d = "down"
+		}
+		fmt.Fprintf(&buf, "-- [%d/%d] %s %d %s (%s)\n", i+1, len(files), d, f.Version, f.Name, f.FileName)
+		if f.Func != nil {
+			buf.WriteString("-- Go function\n")
+		}
+		buf.Write(f.Content)
+		if len(f.Content) > 0 && f.Content[len(f.Content)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+		buf.WriteByte('\n')
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
@@ -0,0 +1,89 @@
+package migrate
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/file"
+	"github.com/gemnasium/migrate/migrate/direction"
+)
+
+// RetryPolicy tells how migration files failing with a transient error,
+// as reported by drivers implementing driver.RetryClassifier, are run
+// again. Only files safe to run again are retried: the ones run in a
+// transaction (see driver.Transactional), and the ones with a
+// migrate:retries directive, which overrides Attempts.
+type RetryPolicy struct {
+	// Attempts is the maximum number of runs of a file, the first one
+	// included. Zero or one disables retries.
+	Attempts int
+
+	// Backoff is the wait before the first retry. It doubles before
+	// each of the next ones, up to MaxBackoff if not zero.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Jitter randomly changes each wait by up to this fraction of it,
+	// between 0 and 1, so that concurrent runs don't retry in lockstep.
+	Jitter float64
+}
+
+// jitterRand is seeded apart from the global source, so that processes
+// started together don't wait the same time.
+var (
+	jitterRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterRandMu sync.Mutex
+)
+
+// wait returns the time to wait before the nth retry, starting at 1.
+func (p RetryPolicy) wait(n int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < n && (p.MaxBackoff == 0 || wait < p.MaxBackoff); i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		jitterRandMu.Lock()
+		wait += time.Duration((jitterRand.Float64()*2 - 1) * p.Jitter * float64(wait))
+		jitterRandMu.Unlock()
+	}
+	return wait
+}
+
+// attempts returns the maximum number of runs of f. Files run in the
+// transaction of the run can't run again once it failed.
+func (m *Migrator) attempts(f file.File) int {
+	if m.TransactionMode == TxAll {
+		return 1
+	}
+	if directives, err := f.Directives(); err == nil && directives.Retries > 0 {
+		return directives.Retries + 1
+	}
+	if m.inTransaction(f) && m.Retry.Attempts > 1 {
+		return m.Retry.Attempts
+	}
+	return 1
+}
+
+// retryable reports whether the driver classifies err as transient.
+func (m *Migrator) retryable(err error) bool {
+	c, ok := m.driver.(driver.RetryClassifier)
+	return ok && c.Retryable(err)
+}
+
+// resetDirty removes the dirty flag a failed run of f left, so that it
+// can run again. Files run in a transaction leave none.
+func (m *Migrator) resetDirty(f file.File) error {
+	if m.inTransaction(f) {
+		return nil
+	}
+	d, ok := m.driver.(driver.DirtyTracker)
+	if !ok {
+		return nil
+	}
+	return d.ClearDirty(f.Version, f.Direction == direction.Down)
+}
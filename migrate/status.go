@@ -0,0 +1,157 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/file"
+)
+
+// MigrationStatus describes the state of a single migration.
+type MigrationStatus struct {
+	Version file.Version `json:"version"`
+
+	// Name is empty for applied versions without migration files,
+	// unless the driver recorded it.
+	Name string `json:"name"`
+
+	Applied bool `json:"applied"`
+
+	// AppliedAt is nil when unknown.
+	AppliedAt *time.Time `json:"applied_at"`
+
+	// Missing is true for applied versions without migration files.
+	Missing bool `json:"missing,omitempty"`
+
+	// OutOfOrder is true for pending migrations older than the current
+	// version. Up still applies them.
+	OutOfOrder bool `json:"out_of_order,omitempty"`
+
+	// Dirty is true if the migration didn't complete.
+	Dirty bool `json:"dirty,omitempty"`
+}
+
+// State returns "applied" or "pending".
+func (s MigrationStatus) State() string {
+	if s.Applied {
+		return "applied"
+	}
+	return "pending"
+}
+
+// Status lists every migration found in the migrations path or
+// applied to the database, oldest first.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	files, err := m.readMigrationFiles()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := m.driver.Versions()
+	if err != nil {
+		return nil, err
+	}
+	dirty, err := m.Dirty(ctx)
+	if err != nil {
+		return nil, err
+	}
+	records := map[file.Version]driver.Record{}
+	if r, ok := m.driver.(driver.RecordReader); ok {
+		applied, err := r.Records()
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range applied {
+			records[record.Version] = record
+		}
+	}
+
+	var current file.Version
+	for _, v := range versions {
+		if v > current {
+			current = v
+		}
+	}
+
+	statuses := make([]MigrationStatus, 0, len(files)+len(versions))
+	known := make(file.Versions, 0, len(files))
+	for _, migrationFile := range files {
+		s := MigrationStatus{
+			Version: migrationFile.Version,
+			Applied: versions.Contains(migrationFile.Version),
+			Dirty:   dirty.Contains(migrationFile.Version),
+		}
+		if migrationFile.UpFile != nil {
+			s.Name = migrationFile.UpFile.Name
+		} else if migrationFile.DownFile != nil {
+			s.Name = migrationFile.DownFile.Name
+		}
+		if s.Applied {
+			s.AppliedAt = appliedAt(records[s.Version])
+		}
+		s.OutOfOrder = !s.Applied && s.Version < current
+		statuses = append(statuses, s)
+		known = append(known, migrationFile.Version)
+	}
+	for _, v := range versions {
+		if !known.Contains(v) {
+			statuses = append(statuses, MigrationStatus{
+				Version:   v,
+				Name:      records[v].Name,
+				Applied:   true,
+				AppliedAt: appliedAt(records[v]),
+				Missing:   true,
+				Dirty:     dirty.Contains(v),
+			})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// appliedAt returns the time record was applied, if known.
+func appliedAt(record driver.Record) *time.Time {
+	if record.AppliedAt.IsZero() {
+		return nil
+	}
+	t := record.AppliedAt
+	return &t
+}
+
+// WriteStatus writes statuses to w as a table.
+func WriteStatus(w io.Writer, statuses []MigrationStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATE\tAPPLIED AT\tFLAGS")
+	for _, s := range statuses {
+		appliedAt := "-"
+		if s.AppliedAt != nil {
+			appliedAt = s.AppliedAt.UTC().Format(time.RFC3339)
+		}
+		name := s.Name
+		if name == "" {
+			name = "-"
+		}
+		flags := []string{}
+		if s.Missing {
+			flags = append(flags, "missing")
+		}
+		if s.OutOfOrder {
+			flags = append(flags, "out-of-order")
+		}
+		if s.Dirty {
+			flags = append(flags, "dirty")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", s.Version, name, s.State(), appliedAt, strings.Join(flags, ","))
+	}
+	return tw.Flush()
+}
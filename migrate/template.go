@@ -0,0 +1,74 @@
+package migrate
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"text/template"
+	"time"
+
+	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/file"
+	"github.com/gemnasium/migrate/migrate/direction"
+)
+
+// TemplateData is the data available to the templates of Create.
+type TemplateData struct {
+	// Version and Name of the new migration
+	Version file.Version
+	Name    string
+
+	// Direction is "up" or "down"
+	Direction string
+
+	// Driver is the name of the driver, such as "postgres"
+	Driver string
+
+	// Timestamp is the creation time of the migration, in UTC
+	Timestamp time.Time
+}
+
+// templateFuncs are the functions available to the templates of Create,
+// in addition to the text/template ones.
+var templateFuncs = template.FuncMap{
+	"env": os.Getenv,
+}
+
+// renderTemplate renders the content of f from the template of its
+// direction in m.TemplateDir: <driver>.<direction>.tmpl, such as
+// postgres.up.tmpl, or else <direction>.tmpl. Without template,
+// the content is empty.
+func (m *Migrator) renderTemplate(f *file.File, created time.Time) ([]byte, error) {
+	d := "up"
+	if f.Direction == direction.Down {
+		d = "down"
+	}
+	data := TemplateData{
+		Version:   f.Version,
+		Name:      f.Name,
+		Direction: d,
+		Driver:    driver.Name(m.driver),
+		Timestamp: created,
+	}
+
+	candidates := []string{d + ".tmpl"}
+	if data.Driver != "" {
+		candidates = append([]string{data.Driver + "." + d + ".tmpl"}, candidates...)
+	}
+	for _, candidate := range candidates {
+		templatePath := path.Join(m.TemplateDir, candidate)
+		if _, err := os.Stat(templatePath); os.IsNotExist(err) {
+			continue
+		}
+		t, err := template.New(candidate).Funcs(templateFuncs).ParseFiles(templatePath)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return []byte(""), nil
+}
@@ -0,0 +1,135 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/event"
+	"github.com/gemnasium/migrate/file"
+)
+
+// TransactionMode tells which transactions the migration files of a run
+// are applied in. Modes other than TxPerFile need a driver implementing
+// driver.TxMigrator, like the Postgres and sqlite3 drivers.
+type TransactionMode string
+
+const (
+	// TxPerFile lets the driver run each migration file in its own
+	// transaction, unless the file has the no-transaction directive.
+	// It is the default, also used if TransactionMode is empty.
+	TxPerFile TransactionMode = "per-file"
+
+	// TxAll applies all the migration files of a run in a single
+	// transaction: either they are all applied, or none is. Files with
+	// the no-transaction directive are rejected before the run starts,
+	// and failing files aren't retried.
+	TxAll TransactionMode = "all"
+
+	// TxNone runs all migration files outside of any transaction, as if
+	// they had the no-transaction directive.
+	TxNone TransactionMode = "none"
+)
+
+// runTx is the transaction mode of a run, for the modes handing
+// migration files over to driver.TxMigrator.MigrateTx.
+type runTx struct {
+	migrator driver.TxMigrator
+
+	// tx is the transaction of the run, nil for TxNone.
+	tx driver.Tx
+}
+
+// checkTransactionMode returns an error if m.TransactionMode is unknown
+// or not supported by the driver.
+func (m *Migrator) checkTransactionMode() error {
+	switch m.TransactionMode {
+	case "", TxPerFile:
+		return nil
+	case TxAll, TxNone:
+		if _, ok := m.driver.(driver.TxMigrator); !ok {
+			return fmt.Errorf("The driver doesn't support the %q transaction mode", m.TransactionMode)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown transaction mode %q, use %q, %q or %q", m.TransactionMode, TxPerFile, TxAll, TxNone)
+}
+
+// beginTx returns the transaction mode of a run, beginning its
+// transaction for TxAll. It returns nil for TxPerFile.
+func (m *Migrator) beginTx(ctx context.Context) (*runTx, error) {
+	switch m.TransactionMode {
+	case TxAll:
+		migrator := m.driver.(driver.TxMigrator)
+		tx, err := migrator.BeginTx(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &runTx{migrator: migrator, tx: tx}, nil
+	case TxNone:
+		return &runTx{migrator: m.driver.(driver.TxMigrator)}, nil
+	}
+	return nil, nil
+}
+
+// endTx commits the transaction of a run if it succeeded, and rolls
+// it back otherwise, clearing the applied files of r. err is the error
+// of the run, endTx returns it or the error committing.
+func (m *Migrator) endTx(r *Result, t *runTx, err error) error {
+	if t == nil || t.tx == nil {
+		return err
+	}
+	if err == nil {
+		if err := t.tx.Commit(); err != nil {
+			m.fail(r, err)
+			r.Files = file.Files{}
+			return err
+		}
+		return nil
+	}
+
+	// a transaction already rolled back because its context was
+	// cancelled is not reported as an error
+	if rollbackErr := t.tx.Rollback(); rollbackErr != nil && rollbackErr != sql.ErrTxDone {
+		m.fail(r, rollbackErr)
+	}
+	if len(r.Files) > 0 {
+		m.emit(event.Event{Kind: event.Warning,
+			Message: fmt.Sprintf("Rolled back the %d migrations applied in the transaction of the run.", len(r.Files))})
+		r.Files = file.Files{}
+	}
+	return err
+}
+
+// checkTransaction returns an error if f can't run in the transaction
+// mode of m.
+func (m *Migrator) checkTransaction(f file.File) error {
+	if m.TransactionMode != TxAll {
+		return nil
+	}
+	directives, err := f.Directives()
+	if err != nil {
+		return err
+	}
+	if directives.NoTransaction {
+		return fmt.Errorf("%s has the no-transaction directive, it can't run in the %q transaction mode", f.FileName, TxAll)
+	}
+	if t, ok := m.driver.(driver.Transactional); ok && !t.InTransaction(f) {
+		return fmt.Errorf("%s runs outside of a transaction, it can't run in the %q transaction mode", f.FileName, TxAll)
+	}
+	return nil
+}
+
+// inTransaction reports whether f runs in a transaction, which
+// failures leave no trace of.
+func (m *Migrator) inTransaction(f file.File) bool {
+	switch m.TransactionMode {
+	case TxAll:
+		return true
+	case TxNone:
+		return false
+	}
+	t, ok := m.driver.(driver.Transactional)
+	return ok && t.InTransaction(f)
+}
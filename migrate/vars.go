@@ -0,0 +1,86 @@
+package migrate
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/event"
+	"github.com/gemnasium/migrate/file"
+)
+
+// secretMask replaces the values of secret variables.
+const secretMask = "****"
+
+// expandsVars reports whether the ${NAME} placeholders of
+// migration files are substituted.
+func (m *Migrator) expandsVars() bool {
+	return m.Vars != nil || m.EnvVars
+}
+
+// lookupVar returns the value of the variable name,
+// from m.Vars or else from the environment if m.EnvVars is set.
+func (m *Migrator) lookupVar(name string) (string, bool) {
+	if value, ok := m.Vars[name]; ok {
+		return value, true
+	}
+	if m.EnvVars {
+		return os.LookupEnv(name)
+	}
+	return "", false
+}
+
+// expand substitutes the variables of f, if enabled.
+func (m *Migrator) expand(f *file.File) error {
+	if !m.expandsVars() || f.Func != nil {
+		return nil
+	}
+	return f.Expand(m.lookupVar)
+}
+
+// mask replaces the values of the secret variables in s.
+func (m *Migrator) mask(s string) string {
+	for _, name := range m.SecretVars {
+		if value, ok := m.lookupVar(name); ok && value != "" {
+			s = strings.Replace(s, value, secretMask, -1)
+		}
+	}
+	return s
+}
+
+// maskEvent returns e with the values of the secret variables masked
+// in its file content, message, statement and error.
+func (m *Migrator) maskEvent(e event.Event) event.Event {
+	if len(m.SecretVars) == 0 {
+		return e
+	}
+	if e.File != nil {
+		f := *e.File
+		f.Content = []byte(m.mask(string(f.Content)))
+		e.File = &f
+	}
+	e.Message = m.mask(e.Message)
+	e.Statement = m.mask(e.Statement)
+	e.Err = m.maskError(e.Err)
+	return e
+}
+
+// maskError returns err with the values of the secret variables masked
+// in its message. A *driver.MigrationError keeps its location, only its
+// underlying error is replaced.
+func (m *Migrator) maskError(err error) error {
+	if err == nil || len(m.SecretVars) == 0 {
+		return err
+	}
+	masked := m.mask(err.Error())
+	if masked == err.Error() {
+		return err
+	}
+	if migrationErr, ok := err.(*driver.MigrationError); ok {
+		e := *migrationErr
+		e.Err = m.maskError(e.Err)
+		return &e
+	}
+	return errors.New(masked)
+}
@@ -0,0 +1,125 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gemnasium/migrate/driver"
+	"github.com/gemnasium/migrate/file"
+)
+
+// Drift lists the applied migrations that don't match the migration files.
+type Drift struct {
+	// Modified holds the versions whose up file changed since it was applied.
+	Modified file.Versions
+
+	// Missing holds the applied versions without an up file.
+	Missing file.Versions
+
+	// Unknown holds the applied versions without a recorded checksum,
+	// which can't be verified. They are not considered drift.
+	Unknown file.Versions
+}
+
+// Detected is true if some applied migrations were modified or are missing.
+func (d *Drift) Detected() bool {
+	return len(d.Modified) > 0 || len(d.Missing) > 0
+}
+
+// Error implements the error interface, so that Drift can be returned
+// by the runs refusing to migrate a drifted database.
+func (d *Drift) Error() string {
+	parts := make([]string, 0, 2)
+	if len(d.Modified) > 0 {
+		parts = append(parts, fmt.Sprintf("modified versions %s", joinVersions(d.Modified)))
+	}
+	if len(d.Missing) > 0 {
+		parts = append(parts, fmt.Sprintf("missing versions %s", joinVersions(d.Missing)))
+	}
+	return fmt.Sprintf("Applied migrations drifted from migration files: %s", strings.Join(parts, ", "))
+}
+
+// Verify compares the checksums recorded for the applied migrations with
+// the up files found in the migrations path.
+// Drivers not recording checksums report all applied versions as unknown.
+func (m *Migrator) Verify(ctx context.Context) (*Drift, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	files, err := m.readMigrationFiles()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := m.driver.Versions()
+	if err != nil {
+		return nil, err
+	}
+	return m.drift(files, versions)
+}
+
+// verified is a step refusing to go on if the applied migrations drifted,
+// unless the Migrator ignores drift. It never selects files.
+func (m *Migrator) verified(files file.MigrationFiles, versions file.Versions) (file.Files, error) {
+	if m.IgnoreDrift {
+		return nil, nil
+	}
+	d, err := m.drift(files, versions)
+	if err != nil {
+		return nil, err
+	}
+	if d.Detected() {
+		return nil, d
+	}
+	return nil, nil
+}
+
+func (m *Migrator) drift(files file.MigrationFiles, versions file.Versions) (*Drift, error) {
+	checksums := map[file.Version]string{}
+	if r, ok := m.driver.(driver.ChecksumReader); ok {
+		var err error
+		if checksums, err = r.Checksums(); err != nil {
+			return nil, err
+		}
+	}
+
+	upFiles := make(map[file.Version]*file.File, len(files))
+	for _, migrationFile := range files {
+		if migrationFile.UpFile != nil {
+			upFiles[migrationFile.Version] = migrationFile.UpFile
+		}
+	}
+
+	d := &Drift{Modified: file.Versions{}, Missing: file.Versions{}, Unknown: file.Versions{}}
+	sorted := append(file.Versions{}, versions...)
+	sort.Sort(sorted)
+	for _, v := range sorted {
+		f, ok := upFiles[v]
+		if !ok {
+			d.Missing = append(d.Missing, v)
+			continue
+		}
+		recorded, ok := checksums[v]
+		if !ok {
+			d.Unknown = append(d.Unknown, v)
+			continue
+		}
+		checksum, err := f.Checksum()
+		if err != nil {
+			return nil, err
+		}
+		if checksum != recorded {
+			d.Modified = append(d.Modified, v)
+		}
+	}
+	return d, nil
+}
+
+func joinVersions(versions file.Versions) string {
+	s := make([]string, len(versions))
+	for i, v := range versions {
+		s[i] = fmt.Sprint(uint64(v))
+	}
+	return strings.Join(s, ", ")
+}
@@ -21,7 +21,8 @@ func Close(pipe chan interface{}, err error) {
 // WaitAndRedirect waits for pipe to be closed and
 // redirects all messages from pipe to redirectPipe
 // while it waits. It also checks if there was an
-// interrupt send and will quit gracefully if yes.
+// interrupt send and reports it as not ok.
+// Terminating the process is left to the caller.
 func WaitAndRedirect(pipe, redirectPipe chan interface{}, interrupt chan os.Signal) (ok bool) {
 	errorReceived := false
 	interruptsReceived := 0
@@ -31,11 +32,9 @@ func WaitAndRedirect(pipe, redirectPipe chan interface{}, interrupt chan os.Sign
 
 			case <-interrupt:
 				interruptsReceived += 1
-				if interruptsReceived > 1 {
-					os.Exit(5)
-				} else {
+				if interruptsReceived == 1 {
 					// add white space at beginning for ^C splitting
-					redirectPipe <- " Aborting after this migration ... Hit again to force quit."
+					redirectPipe <- " Aborting after this migration ..."
 				}
 
 			case item, ok := <-pipe:
@@ -0,0 +1,266 @@
+// Package sqlsplit splits the content of migration files into the
+// statements drivers run one at a time.
+package sqlsplit
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gemnasium/migrate/file"
+)
+
+// Dialect tells Split which syntax of a SQL flavour to understand, on top
+// of '…', "…" and `…` quoting with doubled quotes, -- line comments and
+// /* … */ block comments.
+type Dialect struct {
+	// HashComments makes # start a line comment.
+	HashComments bool
+
+	// SlashComments makes // start a line comment.
+	SlashComments bool
+
+	// BackslashEscapes makes \ escape the next character of '…' and "…".
+	BackslashEscapes bool
+
+	// DollarQuotes enables $$…$$ and $tag$…$tag$ strings.
+	DollarQuotes bool
+
+	// Delimiter enables the DELIMITER command of the mysql client,
+	// changing the ";" ending statements, for stored procedure bodies.
+	Delimiter bool
+
+	// TriggerBlocks keeps the BEGIN … END body of CREATE TRIGGER
+	// statements in one piece.
+	TriggerBlocks bool
+
+	// Batches keeps BEGIN BATCH … APPLY BATCH statements in one piece.
+	Batches bool
+}
+
+// Dialects of the drivers.
+var (
+	MySQL     = Dialect{HashComments: true, BackslashEscapes: true, Delimiter: true}
+	Postgres  = Dialect{DollarQuotes: true}
+	SQLite    = Dialect{TriggerBlocks: true}
+	Crate     = Dialect{}
+	Cassandra = Dialect{SlashComments: true, DollarQuotes: true, Batches: true}
+)
+
+// Statement is a statement of a migration file.
+type Statement struct {
+	// Text is the statement, without the delimiter ending it.
+	// Comments preceding it are left out.
+	Text string
+
+	// Offset is the byte offset of Text in the content it was split from.
+	Offset int
+}
+
+// dollarTagRegex matches the opening tag of dollar quoted strings.
+var dollarTagRegex = regexp.MustCompile(`^\$(?:[A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// Split splits content into statements ending with ";", or the delimiter
+// set by a DELIMITER command. Delimiters inside quotes, comments and
+// blocks are ignored, and so are statements made of comments only.
+// Unterminated quotes and comments are an error.
+func Split(content []byte, dialect Dialect) ([]Statement, error) {
+	s := &splitter{content: content, dialect: dialect, delimiter: ";"}
+	if err := s.split(); err != nil {
+		line, column := file.LineColumnFromOffset(content, s.pos)
+		return nil, fmt.Errorf("line %d column %d: %v", line, column, err)
+	}
+	return s.statements, nil
+}
+
+type splitter struct {
+	content    []byte
+	dialect    Dialect
+	delimiter  string
+	statements []Statement
+
+	pos   int // position of the next byte to read
+	start int // offset of the current statement, -1 until it has code
+
+	// keywords of the current statement
+	firstWord, lastWord string
+	trigger             bool
+	blockDepth          int
+	batch               bool
+}
+
+func (s *splitter) split() error {
+	s.start = -1
+	for s.pos < len(s.content) {
+		rest := s.content[s.pos:]
+		c := rest[0]
+		switch {
+		case s.start < 0 && s.dialect.Delimiter && isDelimiterCommand(rest):
+			if err := s.readDelimiterCommand(); err != nil {
+				return err
+			}
+		case s.atDelimiter(s.pos):
+			s.endStatement(s.pos)
+			s.pos += len(s.delimiter)
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			s.pos++
+		case bytes.HasPrefix(rest, []byte("--")),
+			s.dialect.HashComments && c == '#',
+			s.dialect.SlashComments && bytes.HasPrefix(rest, []byte("//")):
+			s.skipLine()
+		case bytes.HasPrefix(rest, []byte("/*")):
+			end := bytes.Index(rest[2:], []byte("*/"))
+			if end < 0 {
+				return fmt.Errorf("unterminated comment")
+			}
+			s.pos += end + 4
+		case c == '\'' || c == '"' || c == '`':
+			s.code()
+			if err := s.readQuoted(c); err != nil {
+				return err
+			}
+		case c == '$' && s.dialect.DollarQuotes && !s.afterWord():
+			s.code()
+			tag := dollarTagRegex.Find(rest)
+			if tag == nil {
+				s.pos++
+				break
+			}
+			end := bytes.Index(rest[len(tag):], tag)
+			if end < 0 {
+				return fmt.Errorf("unterminated %s string", tag)
+			}
+			s.pos += len(tag) + end + len(tag)
+		case isWordStart(c):
+			s.code()
+			s.readWord()
+		default:
+			s.code()
+			s.pos++
+		}
+	}
+	s.endStatement(len(s.content))
+	return nil
+}
+
+// atDelimiter reports whether the current statement ends at offset i,
+// as words like END$$ can run into the delimiter.
+func (s *splitter) atDelimiter(i int) bool {
+	return s.blockDepth == 0 && !s.batch && bytes.HasPrefix(s.content[i:], []byte(s.delimiter))
+}
+
+// code records the start of the current statement at the first byte
+// which isn't blank nor a comment.
+func (s *splitter) code() {
+	if s.start < 0 {
+		s.start = s.pos
+	}
+}
+
+// endStatement adds the current statement, ending at end, if it has code.
+func (s *splitter) endStatement(end int) {
+	if s.start >= 0 {
+		text := strings.TrimRight(string(s.content[s.start:end]), " \t\r\n")
+		s.statements = append(s.statements, Statement{Text: text, Offset: s.start})
+	}
+	s.start = -1
+	s.firstWord, s.lastWord = "", ""
+	s.trigger, s.blockDepth, s.batch = false, 0, false
+}
+
+// skipLine moves to the end of the current line.
+func (s *splitter) skipLine() {
+	if end := bytes.IndexByte(s.content[s.pos:], '\n'); end >= 0 {
+		s.pos += end
+	} else {
+		s.pos = len(s.content)
+	}
+}
+
+// readQuoted reads a string or identifier quoted with quote.
+func (s *splitter) readQuoted(quote byte) error {
+	start := s.pos
+	for i := s.pos + 1; i < len(s.content); i++ {
+		switch c := s.content[i]; {
+		case c == '\\' && quote != '`' && s.dialect.BackslashEscapes:
+			i++
+		case c == quote && i+1 < len(s.content) && s.content[i+1] == quote:
+			i++
+		case c == quote:
+			s.pos = i + 1
+			return nil
+		}
+	}
+	s.pos = start
+	return fmt.Errorf("unterminated %c quote", quote)
+}
+
+// readWord reads a keyword or identifier, keeping track of the blocks
+// the dialect keeps in one piece.
+func (s *splitter) readWord() {
+	end := s.pos
+	for end < len(s.content) && isWordByte(s.content[end]) && !s.atDelimiter(end) {
+		end++
+	}
+	word := strings.ToUpper(string(s.content[s.pos:end]))
+	s.pos = end
+
+	if s.firstWord == "" {
+		s.firstWord = word
+	}
+	if s.dialect.TriggerBlocks {
+		switch {
+		case s.firstWord == "CREATE" && word == "TRIGGER":
+			s.trigger = true
+		case s.trigger && (word == "BEGIN" || word == "CASE"):
+			s.blockDepth++
+		case s.trigger && word == "END" && s.blockDepth > 0:
+			s.blockDepth--
+		}
+	}
+	if s.dialect.Batches && word == "BATCH" {
+		if s.lastWord == "APPLY" {
+			s.batch = false
+		} else if s.firstWord == "BEGIN" {
+			s.batch = true
+		}
+	}
+	s.lastWord = word
+}
+
+// afterWord reports whether the current byte continues a word,
+// such as the $ of the identifier a$b.
+func (s *splitter) afterWord() bool {
+	return s.pos > 0 && isWordByte(s.content[s.pos-1])
+}
+
+// readDelimiterCommand reads a "DELIMITER <delimiter>" line.
+func (s *splitter) readDelimiterCommand() error {
+	line := s.content[s.pos:]
+	if end := bytes.IndexByte(line, '\n'); end >= 0 {
+		line = line[:end]
+	}
+	fields := strings.Fields(string(line[len("DELIMITER"):]))
+	if len(fields) != 1 {
+		return fmt.Errorf("DELIMITER needs a delimiter")
+	}
+	s.delimiter = fields[0]
+	s.pos += len(line)
+	return nil
+}
+
+// isDelimiterCommand reports whether b starts with a DELIMITER command.
+func isDelimiterCommand(b []byte) bool {
+	const command = "DELIMITER"
+	return len(b) > len(command) && strings.EqualFold(string(b[:len(command)]), command) &&
+		(b[len(command)] == ' ' || b[len(command)] == '\t')
+}
+
+func isWordStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isWordByte(c byte) bool {
+	return isWordStart(c) || '0' <= c && c <= '9' || c == '$'
+}
@@ -0,0 +1,80 @@
+package sqlsplit
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		dialect  Dialect
+		expected []string
+	}{
+		{"empty", "", Crate, nil},
+		{"comments only", "-- nothing\n/* to do */\n", Crate, nil},
+		{"statements", "CREATE TABLE a (id INT);\n\n\tCREATE TABLE b (id INT); ", Crate,
+			[]string{"CREATE TABLE a (id INT)", "CREATE TABLE b (id INT)"}},
+		{"no final delimiter", "SELECT 1; SELECT 2", Crate, []string{"SELECT 1", "SELECT 2"}},
+		{"empty statements", ";;SELECT 1;;", Crate, []string{"SELECT 1"}},
+		{"quotes", `INSERT INTO a VALUES ('a;b', 'it''s;', "c;d", ` + "`e;f`" + `);`, Crate,
+			[]string{`INSERT INTO a VALUES ('a;b', 'it''s;', "c;d", ` + "`e;f`" + `)`}},
+		{"backslash escapes", `INSERT INTO a VALUES ('\';'); SELECT 1;`, MySQL,
+			[]string{`INSERT INTO a VALUES ('\';')`, "SELECT 1"}},
+		{"no backslash escapes", `INSERT INTO a VALUES ('\'); SELECT 1;`, SQLite,
+			[]string{`INSERT INTO a VALUES ('\')`, "SELECT 1"}},
+		{"comments", "-- first; statement\nSELECT 1 /* ; */; -- last;\nSELECT 2;", Crate,
+			[]string{"SELECT 1 /* ; */", "SELECT 2"}},
+		{"hash comments", "# a;\nSELECT 1;", MySQL, []string{"SELECT 1"}},
+		{"slash comments", "// a;\nSELECT 1;", Cassandra, []string{"SELECT 1"}},
+		{"dollar quotes", "CREATE FUNCTION f() AS $$ return 1; $$; SELECT $tag$ ; $$ $tag$;", Cassandra,
+			[]string{"CREATE FUNCTION f() AS $$ return 1; $$", "SELECT $tag$ ; $$ $tag$"}},
+		{"postgres function", "CREATE FUNCTION f() RETURNS int AS $body$ BEGIN RETURN 1; END $body$ LANGUAGE plpgsql; VACUUM;", Postgres,
+			[]string{"CREATE FUNCTION f() RETURNS int AS $body$ BEGIN RETURN 1; END $body$ LANGUAGE plpgsql", "VACUUM"}},
+		{"delimiter", "DELIMITER //\nCREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END//\nDELIMITER ;\nCALL p();", MySQL,
+			[]string{"CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END", "CALL p()"}},
+		{"delimiter after word", "DELIMITER $$\nCREATE PROCEDURE p() BEGIN SELECT 1; END$$", MySQL,
+			[]string{"CREATE PROCEDURE p() BEGIN SELECT 1; END"}},
+		{"trigger", "CREATE TRIGGER t AFTER INSERT ON a BEGIN\n  UPDATE b SET n = CASE WHEN n > 1 THEN 0 ELSE n END;\n  DELETE FROM c;\nEND;\nBEGIN;", SQLite,
+			[]string{"CREATE TRIGGER t AFTER INSERT ON a BEGIN\n  UPDATE b SET n = CASE WHEN n > 1 THEN 0 ELSE n END;\n  DELETE FROM c;\nEND", "BEGIN"}},
+		{"batch", "BEGIN UNLOGGED BATCH INSERT INTO a (id) VALUES (1); INSERT INTO a (id) VALUES (2); APPLY BATCH; SELECT 1;", Cassandra,
+			[]string{"BEGIN UNLOGGED BATCH INSERT INTO a (id) VALUES (1); INSERT INTO a (id) VALUES (2); APPLY BATCH", "SELECT 1"}},
+	}
+	for _, tt := range tests {
+		statements, err := Split([]byte(tt.content), tt.dialect)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var texts []string
+		for _, s := range statements {
+			texts = append(texts, s.Text)
+			if !strings.HasPrefix(tt.content[s.Offset:], s.Text) {
+				t.Errorf("%s: expected %q at offset %d", tt.name, s.Text, s.Offset)
+			}
+		}
+		if !reflect.DeepEqual(texts, tt.expected) {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, texts)
+		}
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+	tests := []struct {
+		content  string
+		dialect  Dialect
+		expected string
+	}{
+		{"SELECT 1;\nSELECT 'a;", Crate, "line 2 column 8: unterminated ' quote"},
+		{"SELECT 1 /* a", Crate, "line 1 column 10: unterminated comment"},
+		{"SELECT $$ a", Cassandra, "line 1 column 8: unterminated $$ string"},
+		{"DELIMITER\t\nSELECT 1", MySQL, "line 1 column 1: DELIMITER needs a delimiter"},
+	}
+	for _, tt := range tests {
+		if _, err := Split([]byte(tt.content), tt.dialect); err == nil || err.Error() != tt.expected {
+			t.Errorf("%q: expected error %q, got %v", tt.content, tt.expected, err)
+		}
+	}
+}